@@ -0,0 +1,33 @@
+package imgext
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Bounds on the scan for an APNG's acTL chunk. The acTL chunk must appear
+// before the first IDAT chunk, so only the header region is scanned.
+const (
+	apngMaxChunks   = 64
+	apngMaxScanSize = 1 << 20
+)
+
+// isAPNG determines whether the PNG read from r is animated, i.e. contains an
+// acTL chunk before its image data.
+func isAPNG(r io.ReaderAt) bool {
+	var hdr [8]byte
+	off := int64(8) // skip the PNG signature
+	for i := 0; i < apngMaxChunks && off < apngMaxScanSize; i++ {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return false
+		}
+		switch string(hdr[4:8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		off += 8 + int64(binary.BigEndian.Uint32(hdr[:4])) + 4 // header, data, CRC
+	}
+	return false
+}
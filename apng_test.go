@@ -0,0 +1,61 @@
+package imgext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// pngChunk returns a PNG chunk of the given type & data.
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// insertChunk returns the PNG data with chunk inserted before its first chunk
+// of type before.
+func insertChunk(data []byte, before string, chunk []byte) []byte {
+	i := bytes.Index(data, []byte(before)) - 4 // back up over the chunk length
+	return append(append(append([]byte{}, data[:i]...), chunk...), data[i:]...)
+}
+
+func TestAPNG(t *testing.T) {
+	acTL := pngChunk("acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0}) // two frames, looping forever
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"acTL before IDAT", insertChunk(pngData, "IDAT", acTL), "apng"},
+		{"acTL after IDAT", insertChunk(pngData, "IEND", acTL), "png"},
+		{"no acTL", pngData, "png"},
+		{"other chunks before acTL", insertChunk(insertChunk(pngData, "IDAT", acTL), "acTL", pngChunk("tEXt", []byte("k\x00v"))), "apng"},
+	} {
+		if got, err := (Classifier{APNGExt: "apng"}).ClassifyBytes(test.data); got != test.want || err != nil {
+			t.Errorf("%s: ClassifyBytes with APNGExt = %q, %v; want %q, nil", test.name, got, err, test.want)
+		}
+		// APNGs are plain PNGs unless APNGExt is set.
+		if got, err := ClassifyBytes(test.data); got != "png" || err != nil {
+			t.Errorf("%s: ClassifyBytes = %q, %v; want %q, nil", test.name, got, err, "png")
+		}
+	}
+
+	// The scan stops, without error, at the end of truncated data.
+	sig, ihdr := pngData[:8], pngData[8:8+25]
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"signature only", sig},
+		{"truncated chunk header", append(append(append([]byte{}, sig...), ihdr...), 0, 0, 0)},
+		{"chunk length past end", append(append(append([]byte{}, sig...), ihdr...), 0xFF, 0xFF, 0xFF, 0xF0, 'z', 'z', 'z', 'z')},
+		{"acTL truncated away", insertChunk(pngData, "IDAT", acTL)[:8+25+4]},
+	} {
+		if isAPNG(bytes.NewReader(test.data)) {
+			t.Errorf("%s: isAPNG = true, want false", test.name)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package imgext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Rename describes a single rename, for use with Apply.
+type Rename struct {
+	From, To string
+}
+
+// FileSystem is the interface required of the filesystem on which Apply
+// performs renames.
+type FileSystem interface {
+	Rename(oldpath, newpath string) error
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// OSFileSystem is the FileSystem of the host operating system. Like the imgext
+// command, it performs case-only renames on case-insensitive filesystems via a
+// temporary name.
+type OSFileSystem struct{}
+
+func (OSFileSystem) Rename(oldpath, newpath string) error   { return renameFile(oldpath, newpath) }
+func (OSFileSystem) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+// ExecuteOptions configures Apply. The zero value performs renames one at a
+// time on the host filesystem, refusing to clobber existing files (or to give
+// two renames the same destination) and continuing past errors.
+type ExecuteOptions struct {
+	// Context, if non-nil, stops Apply once it is done: no further renames
+	// are started, and those not started are skipped.
+	Context context.Context
+
+	// Concurrency is the number of renames performed at once. If zero, renames
+	// are performed one at a time.
+	Concurrency int
+
+	// DryRun, if set, checks each rename for collisions but does not perform
+	// it.
+	DryRun bool
+
+	// OnCollision, if non-nil, is called for each rename whose destination
+	// already exists, or is the destination of an earlier rename. It may
+	// return another destination to try instead, or ok=false to fail the
+	// rename with ErrDestinationExists, which is also what happens if
+	// OnCollision is nil. The destination it returns is checked in the same
+	// way; if it also collides, OnCollision is called again with it, up to
+	// 100 times in all.
+	OnCollision func(r Rename) (to string, ok bool)
+
+	// OnError, if non-nil, is called for each rename which fails. If it returns
+	// false, no further renames are started and Apply returns the error. If
+	// OnError is nil, Apply continues past all errors.
+	OnError func(r Rename, err error) bool
+
+	// FileSystem is the filesystem on which renames are performed. If nil,
+	// OSFileSystem is used.
+	FileSystem FileSystem
+}
+
+// Results describes the outcome of Apply.
+type Results struct {
+	Renamed int // renames performed (or which would have been, with DryRun)
+	Skipped int // renames not attempted, because Apply stopped early or they were no-ops
+	Errors  int // renames which failed
+
+	// Outcomes holds the outcome of each rename, in the order given to Apply.
+	Outcomes []Outcome
+}
+
+// Outcome describes the outcome of a single rename performed by Apply.
+type Outcome struct {
+	Rename  Rename // the rename, with the destination actually used
+	Renamed bool   // whether the rename was performed (or would have been, with DryRun)
+	Err     error  // set if the rename failed
+}
+
+// Apply performs the given renames, as planned by e.g. the imgext command's
+// --dry_run --json, per opts. The returned error is non-nil if opts are
+// invalid, or if opts.OnError stopped Apply early; in the latter case, the
+// Results are still valid.
+func Apply(plan []Rename, opts ExecuteOptions) (Results, error) {
+	if opts.Concurrency < 0 {
+		return Results{}, errors.New("concurrency must be non-negative")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 1
+	}
+	if opts.FileSystem == nil {
+		opts.FileSystem = OSFileSystem{}
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+
+	outcomes := make([]Outcome, len(plan))
+	var (
+		wg       sync.WaitGroup
+		stopped  atomic.Bool
+		stopOnce sync.Once
+		stopErr  error // the error which stopped Apply, if any
+		cl       = claims{m: map[string]bool{}}
+	)
+	done := func() bool { return stopped.Load() || opts.Context.Err() != nil }
+	sem := make(chan struct{}, opts.Concurrency)
+	for i, r := range plan {
+		outcomes[i].Rename = r
+		if done() {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(o *Outcome) {
+			defer func() { <-sem; wg.Done() }()
+			if done() {
+				return
+			}
+			applyOne(o, &cl, opts)
+			if o.Err != nil && opts.OnError != nil && !opts.OnError(o.Rename, o.Err) {
+				stopOnce.Do(func() { stopErr = fmt.Errorf("stopped after failing to rename %q: %w", o.Rename.From, o.Err) })
+				stopped.Store(true)
+			}
+		}(&outcomes[i])
+	}
+	wg.Wait()
+
+	res := Results{Outcomes: outcomes}
+	for _, o := range outcomes {
+		switch {
+		case o.Renamed:
+			res.Renamed++
+		case o.Err != nil:
+			res.Errors++
+		default:
+			res.Skipped++
+		}
+	}
+	return res, stopErr
+}
+
+// maxCollisionAttempts is the most times that ExecuteOptions.OnCollision is
+// called for a single rename, so that a resolver which only ever returns
+// colliding destinations cannot stall Apply.
+const maxCollisionAttempts = 100
+
+// applyOne performs the rename described by o, per opts, recording its
+// outcome in o. The destination used is claimed in cl.
+func applyOne(o *Outcome, cl *claims, opts ExecuteOptions) {
+	r := o.Rename
+	if r.From == r.To {
+		return
+	}
+	fromFI, err := opts.FileSystem.Lstat(r.From)
+	if err != nil {
+		o.Err = fmt.Errorf("couldn't stat: %w", wrapKind(err))
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		ok, claimed, err := claimDest(r, fromFI, cl, opts.FileSystem)
+		if err != nil {
+			o.Err = err
+			return
+		}
+		if ok {
+			break
+		}
+		to := ""
+		if opts.OnCollision != nil && attempt < maxCollisionAttempts {
+			to, ok = opts.OnCollision(r)
+		}
+		if !ok {
+			if claimed {
+				o.Err = fmt.Errorf("%w: %q (the destination of another file)", ErrDestinationExists, r.To)
+			} else {
+				o.Err = fmt.Errorf("%w: %q", ErrDestinationExists, r.To)
+			}
+			return
+		}
+		r.To = to
+		o.Rename = r
+	}
+	if !opts.DryRun {
+		if err := opts.FileSystem.Rename(r.From, r.To); err != nil {
+			cl.release(r.To)
+			o.Err = fmt.Errorf("couldn't rename: %w", wrapKind(err))
+			return
+		}
+	}
+	o.Renamed = true
+}
+
+// claimDest claims the destination of r, whose source has the info fromFI, in
+// cl, returning whether it did so. A destination which is already claimed, or
+// which exists in fsys, is not claimed; claimed reports which is the case.
+func claimDest(r Rename, fromFI fs.FileInfo, cl *claims, fsys FileSystem) (ok, claimed bool, err error) {
+	if !cl.claim(r.To) {
+		return false, true, nil
+	}
+	// On case-insensitive filesystems, a case-only rename's destination "exists" as the source.
+	toFI, err := fsys.Lstat(r.To)
+	switch {
+	case err == nil && !os.SameFile(fromFI, toFI):
+		cl.release(r.To)
+		return false, false, nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		cl.release(r.To)
+		return false, false, fmt.Errorf("couldn't stat destination: %w", err)
+	}
+	return true, false, nil
+}
+
+// claims records the destinations claimed by the renames of a call to Apply.
+// It is safe for concurrent use.
+type claims struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+// claim claims the given destination, returning false if it was already
+// claimed.
+func (c *claims) claim(to string) bool {
+	to = filepath.Clean(to)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[to] {
+		return false
+	}
+	c.m[to] = true
+	return true
+}
+
+// release releases a destination claimed by claim.
+func (c *claims) release(to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, filepath.Clean(to))
+}
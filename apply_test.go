@@ -0,0 +1,323 @@
+package imgext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory FileSystem.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]bool
+	fail  map[string]error // errors to return when renaming each source
+}
+
+func newMemFS(files ...string) *memFS {
+	m := &memFS{files: map[string]bool{}, fail: map[string]error{}}
+	for _, fn := range files {
+		m.files[fn] = true
+	}
+	return m
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail[oldpath]; err != nil {
+		return err
+	}
+	if !m.files[oldpath] {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = true
+	return nil
+}
+
+func (m *memFS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.files[name] {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memInfo(path.Base(name)), nil
+}
+
+// list returns the files of m, in sorted order.
+func (m *memFS) list() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var fns []string
+	for fn := range m.files {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	return fmt.Sprint(fns)
+}
+
+// memInfo is the fs.FileInfo of a file of a memFS.
+type memInfo string
+
+func (fi memInfo) Name() string       { return string(fi) }
+func (fi memInfo) Size() int64        { return 0 }
+func (fi memInfo) Mode() fs.FileMode  { return 0666 }
+func (fi memInfo) ModTime() time.Time { return time.Time{} }
+func (fi memInfo) IsDir() bool        { return false }
+func (fi memInfo) Sys() any           { return nil }
+
+// outcome summarizes o, for comparison in tests: the destination used, and
+// either "renamed", "skipped", or the error.
+func outcome(o Outcome) string {
+	switch {
+	case o.Renamed:
+		return o.Rename.To + ": renamed"
+	case o.Err != nil:
+		return o.Rename.To + ": " + o.Err.Error()
+	default:
+		return o.Rename.To + ": skipped"
+	}
+}
+
+func TestApply(t *testing.T) {
+	errBroken := errors.New("broken")
+	for _, test := range []struct {
+		name     string
+		files    []string
+		plan     []Rename
+		opts     ExecuteOptions
+		fail     map[string]error
+		want     []string // outcomes
+		wantErr  bool
+		wantFS   string
+		wantRes  [3]int // renamed, skipped & errors
+		errorsIs error  // wrapped by the first outcome's error, if set
+
+		// sequential is set if the outcomes depend on the order in which
+		// renames are performed, so that they are not performed at once.
+		sequential bool
+	}{
+		{
+			name:    "renames",
+			files:   []string{"a.bin", "b.bin"},
+			plan:    []Rename{{"a.bin", "a.png"}, {"b.bin", "b.jpg"}},
+			want:    []string{"a.png: renamed", "b.jpg: renamed"},
+			wantFS:  "[a.png b.jpg]",
+			wantRes: [3]int{2, 0, 0},
+		},
+		{
+			name:    "no-op",
+			files:   []string{"a.png"},
+			plan:    []Rename{{"a.png", "a.png"}},
+			want:    []string{"a.png: skipped"},
+			wantFS:  "[a.png]",
+			wantRes: [3]int{0, 1, 0},
+		},
+		{
+			name:    "dry run",
+			files:   []string{"a.bin", "b.bin", "b.png"},
+			plan:    []Rename{{"a.bin", "a.png"}, {"b.bin", "b.png"}},
+			opts:    ExecuteOptions{DryRun: true},
+			want:    []string{"a.png: renamed", `b.png: destination already exists: "b.png"`},
+			wantFS:  "[a.bin b.bin b.png]",
+			wantRes: [3]int{1, 0, 1},
+		},
+		{
+			name:     "existing destination",
+			files:    []string{"a.bin", "a.png"},
+			plan:     []Rename{{"a.bin", "a.png"}},
+			want:     []string{`a.png: destination already exists: "a.png"`},
+			wantFS:   "[a.bin a.png]",
+			wantRes:  [3]int{0, 0, 1},
+			errorsIs: ErrDestinationExists,
+		},
+		{
+			name:       "shared destination",
+			files:      []string{"a.bin", "a.dat"},
+			plan:       []Rename{{"a.bin", "a.png"}, {"a.dat", "a.png"}},
+			want:       []string{"a.png: renamed", `a.png: destination already exists: "a.png" (the destination of another file)`},
+			wantFS:     "[a.dat a.png]",
+			wantRes:    [3]int{1, 0, 1},
+			sequential: true,
+		},
+		{
+			name:  "collision resolved",
+			files: []string{"a.bin", "a.dat", "a.png"},
+			plan:  []Rename{{"a.bin", "a.png"}, {"a.dat", "a.png"}},
+			opts: ExecuteOptions{OnCollision: func(r Rename) (string, bool) {
+				return strings.TrimSuffix(r.From, ".bin") + "-1.png", strings.HasSuffix(r.From, ".bin")
+			}},
+			want:    []string{"a-1.png: renamed", `a.png: destination already exists: "a.png"`},
+			wantFS:  "[a-1.png a.dat a.png]",
+			wantRes: [3]int{1, 0, 1},
+		},
+		{
+			// Destinations given by OnCollision are themselves checked.
+			name:  "collision resolved to an existing file",
+			files: []string{"a.bin", "a.png", "a-1.png"},
+			plan:  []Rename{{"a.bin", "a.png"}},
+			opts: ExecuteOptions{OnCollision: func(r Rename) (string, bool) {
+				switch r.To {
+				case "a.png":
+					return "a-1.png", true
+				case "a-1.png":
+					return "a-2.png", true
+				}
+				return "", false
+			}},
+			want:    []string{"a-2.png: renamed"},
+			wantFS:  "[a-1.png a-2.png a.png]",
+			wantRes: [3]int{1, 0, 0},
+		},
+		{
+			name:  "collision unresolved",
+			files: []string{"a.bin", "a.png", "b.png"},
+			plan:  []Rename{{"a.bin", "a.png"}},
+			opts: ExecuteOptions{OnCollision: func(r Rename) (string, bool) {
+				return "b.png", r.To == "a.png"
+			}},
+			want:     []string{`b.png: destination already exists: "b.png"`},
+			wantFS:   "[a.bin a.png b.png]",
+			wantRes:  [3]int{0, 0, 1},
+			errorsIs: ErrDestinationExists,
+		},
+		{
+			name:  "collisions resolved to the same destination",
+			files: []string{"a.bin", "a.dat", "a.png"},
+			plan:  []Rename{{"a.bin", "a.png"}, {"a.dat", "a.png"}},
+			opts: ExecuteOptions{OnCollision: func(r Rename) (string, bool) {
+				return "x.png", r.To == "a.png"
+			}},
+			want:       []string{"x.png: renamed", `x.png: destination already exists: "x.png" (the destination of another file)`},
+			wantFS:     "[a.dat a.png x.png]",
+			wantRes:    [3]int{1, 0, 1},
+			sequential: true,
+		},
+		{
+			// A resolver which never finds a free destination is given up on.
+			name:  "collision resolved to itself",
+			files: []string{"a.bin", "a.png"},
+			plan:  []Rename{{"a.bin", "a.png"}},
+			opts: ExecuteOptions{OnCollision: func(r Rename) (string, bool) {
+				return r.To, true
+			}},
+			want:     []string{`a.png: destination already exists: "a.png"`},
+			wantFS:   "[a.bin a.png]",
+			wantRes:  [3]int{0, 0, 1},
+			errorsIs: ErrDestinationExists,
+		},
+		{
+			name:     "vanished source",
+			plan:     []Rename{{"a.bin", "a.png"}},
+			want:     []string{"a.png: couldn't stat: file vanished: lstat a.bin: file does not exist"},
+			wantFS:   "[]",
+			wantRes:  [3]int{0, 0, 1},
+			errorsIs: ErrVanished,
+		},
+		{
+			// A failed rename's destination is released for later renames.
+			name:       "failure, continuing",
+			files:      []string{"a.bin", "a.dat", "b.bin"},
+			plan:       []Rename{{"a.bin", "a.png"}, {"a.dat", "a.png"}, {"b.bin", "b.png"}},
+			fail:       map[string]error{"a.bin": errBroken},
+			want:       []string{"a.png: couldn't rename: broken", "a.png: renamed", "b.png: renamed"},
+			wantFS:     "[a.bin a.png b.png]",
+			wantRes:    [3]int{2, 0, 1},
+			sequential: true,
+		},
+		{
+			name:       "failure, stopping",
+			files:      []string{"a.bin", "b.bin", "c.bin"},
+			plan:       []Rename{{"a.bin", "a.png"}, {"b.bin", "b.png"}, {"c.bin", "c.png"}},
+			fail:       map[string]error{"b.bin": errBroken},
+			opts:       ExecuteOptions{OnError: func(Rename, error) bool { return false }},
+			want:       []string{"a.png: renamed", "b.png: couldn't rename: broken", "c.png: skipped"},
+			wantErr:    true,
+			wantFS:     "[a.png b.bin c.bin]",
+			wantRes:    [3]int{1, 1, 1},
+			sequential: true,
+		},
+		{
+			name:    "cancelled",
+			files:   []string{"a.bin"},
+			plan:    []Rename{{"a.bin", "a.png"}},
+			opts:    ExecuteOptions{Context: cancelledContext()},
+			want:    []string{"a.png: skipped"},
+			wantFS:  "[a.bin]",
+			wantRes: [3]int{0, 1, 0},
+		},
+	} {
+		for _, conc := range []int{0, 1, 4} {
+			if conc > 1 && test.sequential {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/concurrency=%d", test.name, conc), func(t *testing.T) {
+				fsys := newMemFS(test.files...)
+				for from, err := range test.fail {
+					fsys.fail[from] = err
+				}
+				opts := test.opts
+				opts.FileSystem, opts.Concurrency = fsys, conc
+				res, err := Apply(test.plan, opts)
+				if (err != nil) != test.wantErr {
+					t.Errorf("Apply error = %v, want error: %t", err, test.wantErr)
+				}
+				var got []string
+				for _, o := range res.Outcomes {
+					got = append(got, outcome(o))
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("Outcomes = %q, want %q", got, test.want)
+				}
+				if got := [3]int{res.Renamed, res.Skipped, res.Errors}; got != test.wantRes {
+					t.Errorf("Got %d renamed, %d skipped & %d errors, want %d, %d & %d", got[0], got[1], got[2], test.wantRes[0], test.wantRes[1], test.wantRes[2])
+				}
+				if got := fsys.list(); got != test.wantFS {
+					t.Errorf("Files afterward = %s, want %s", got, test.wantFS)
+				}
+				if test.errorsIs != nil && !errors.Is(res.Outcomes[0].Err, test.errorsIs) {
+					t.Errorf("Error %v does not wrap %v", res.Outcomes[0].Err, test.errorsIs)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyConcurrentClaims(t *testing.T) {
+	// Many renames to the same destination, performed at once: exactly one
+	// may succeed.
+	var files []string
+	var plan []Rename
+	for i := 0; i < 100; i++ {
+		fn := fmt.Sprintf("%d.bin", i)
+		files = append(files, fn)
+		plan = append(plan, Rename{fn, "a.png"})
+	}
+	res, err := Apply(plan, ExecuteOptions{Concurrency: 16, FileSystem: newMemFS(files...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Renamed != 1 || res.Errors != 99 {
+		t.Errorf("Got %d renamed & %d errors, want 1 & 99", res.Renamed, res.Errors)
+	}
+}
+
+func TestApplyBadOptions(t *testing.T) {
+	if _, err := Apply(nil, ExecuteOptions{Concurrency: -1}); err == nil {
+		t.Error("Apply with negative concurrency succeeded, want error")
+	}
+}
+
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
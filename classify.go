@@ -0,0 +1,134 @@
+// Package imgext determines the types of image files from their content, so
+// that they can be given the correct extension. It is the library behind the
+// imgext command, in cmd/imgext.
+package imgext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	// The below blank includes are to allow support for various image file formats.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// typeMap maps from the names of formats, as reported by image.DecodeConfig,
+// to the extension that files of that format should have, where they differ.
+var typeMap = map[string]string{
+	"jpeg": "jpg",
+}
+
+// A Classifier determines the types of files from their content. The zero
+// value recognizes the formats of the registered image decoders & sniffers,
+// such as PNG, JPEG, GIF & JPEG XL.
+type Classifier struct {
+	// RAW, if set, recognizes RAW camera formats (CR2, NEF, ARW, etc.) by their
+	// headers. These heuristics may be imperfect.
+	RAW bool
+
+	// SignatureOnly, if set, recognizes the formats supported by the built-in
+	// decoders by their signature alone, reading only the start of each file
+	// rather than everything up to the image dimensions. Files which are
+	// corrupt past their signature will not be noticed.
+	SignatureOnly bool
+
+	// NonImages, if set, classifies files which are not recognized as images
+	// by their MIME type, as detected by http.DetectContentType, so that e.g.
+	// PDFs & plain text files are also given the correct extension.
+	NonImages bool
+
+	// APNGExt, if set, is the extension (without a leading dot) given to
+	// animated PNGs. By default, they are classified like any other PNG.
+	APNGExt string
+}
+
+// ClassifyBytes determines the type of the image held in data, returning the
+// extension (without a leading dot) that it should have. It is equivalent to
+// the zero Classifier's ClassifyBytes method.
+func ClassifyBytes(data []byte) (ext string, err error) {
+	return Classifier{}.ClassifyBytes(data)
+}
+
+// ClassifyBytes determines the type of the image held in data, returning the
+// extension (without a leading dot) that it should have. Detection is the same
+// as for files on disk, and errors likewise wrap the sentinel errors.
+func (c Classifier) ClassifyBytes(data []byte) (ext string, err error) {
+	return c.Classify(bytes.NewReader(data))
+}
+
+// Classify determines the type of the image read from r, returning the
+// extension (without a leading dot) that it should have. Errors wrap the
+// sentinel error describing their kind, if any: notably, content which is not
+// recognized gives ErrUnsupportedFormat, and empty content gives ErrEmpty.
+func (c Classifier) Classify(r io.ReaderAt) (ext string, err error) {
+	return c.ClassifyName(r, "")
+}
+
+// ClassifyName is like Classify, but is also given the name of the file being
+// classified. Files which are classified by their MIME type, per NonImages,
+// keep their current extension if it is one used for that type (e.g. a DOCX
+// file, which is detected as a ZIP archive, or an SVG image, which is detected
+// as XML); other files are classified as by Classify.
+func (c Classifier) ClassifyName(r io.ReaderAt, name string) (ext string, err error) {
+	hdr := make([]byte, snifferHeaderSize)
+	n, err := r.ReadAt(hdr, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("couldn't read: %w", wrapKind(err))
+	}
+	hdr = hdr[:n]
+	if n == 0 {
+		return "", ErrEmpty
+	}
+
+	typ, ok, err := c.sniff(hdr)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		_, decodedTyp, err := image.DecodeConfig(io.NewSectionReader(r, 0, math.MaxInt64))
+		if err != nil {
+			// The image decoders are authoritative; only fall back to
+			// content-type detection if none recognize the file.
+			if c.NonImages && errors.Is(err, image.ErrFormat) {
+				if ext, ok := sniffContentType(hdr, strings.TrimPrefix(Ext(name), ".")); ok {
+					return ext, nil
+				}
+			}
+			return "", wrapKind(err)
+		}
+		typ = decodedTyp
+	}
+	if translatedTyp, ok := typeMap[typ]; ok {
+		typ = translatedTyp
+	}
+	if typ == "png" && c.APNGExt != "" && isAPNG(r) {
+		typ = c.APNGExt
+	}
+	return typ, nil
+}
+
+// NewName returns the name that the file fn should have, given that it is of
+// type typ: fn with its extension, if any, replaced by typ. The directory is
+// left untouched. If fn has no final path element (e.g. it ends in a
+// separator), it is returned unchanged.
+func NewName(fn, typ string) string {
+	if _, base := filepath.Split(fn); base == "" {
+		return fn
+	}
+	return fmt.Sprintf("%s.%s", fn[:len(fn)-len(Ext(fn))], typ)
+}
+
+// Ext returns the extension of fn, including the leading dot. Unlike
+// filepath.Ext, a dot beginning the final path element (as in a Unix dotfile
+// such as ".bashrc") does not begin an extension.
+func Ext(fn string) string {
+	_, base := filepath.Split(fn)
+	return filepath.Ext(strings.TrimPrefix(base, "."))
+}
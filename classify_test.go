@@ -0,0 +1,93 @@
+package imgext
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fixture content, of known type.
+var (
+	jpegData = encodeImage(func(b *bytes.Buffer, m image.Image) error { return jpeg.Encode(b, m, nil) })
+	pngData  = encodeImage(func(b *bytes.Buffer, m image.Image) error { return png.Encode(b, m) })
+	gifData  = encodeImage(func(b *bytes.Buffer, m image.Image) error { return gif.Encode(b, m, nil) })
+	textData = []byte("hello, world\n")
+)
+
+// encodeImage returns a small image, as encoded by enc.
+func encodeImage(enc func(*bytes.Buffer, image.Image) error) []byte {
+	var b bytes.Buffer
+	if err := enc(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+func FuzzClassifyBytes(f *testing.F) {
+	for _, data := range [][]byte{jpegData, pngData, gifData, textData, nil, jxlContainerSig, pngData[:20]} {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := Classifier{RAW: true, NonImages: true, APNGExt: "apng"}
+		ext, err := c.ClassifyBytes(data)
+		switch {
+		case err != nil && ext != "":
+			t.Errorf("ClassifyBytes = %q, %v; want no extension with an error", ext, err)
+		case err == nil && (ext == "" || strings.ContainsAny(ext, `./\`)):
+			t.Errorf("ClassifyBytes = %q, want a non-empty extension without dots or separators", ext)
+		case len(data) == 0 && !errors.Is(err, ErrEmpty):
+			t.Errorf("ClassifyBytes(empty) error = %v, want ErrEmpty", err)
+		}
+		if ext2, err2 := c.ClassifyBytes(data); ext2 != ext || (err2 == nil) != (err == nil) {
+			t.Errorf("ClassifyBytes is not deterministic: got %q, %v then %q, %v", ext, err, ext2, err2)
+		}
+	})
+}
+
+func TestNewName(t *testing.T) {
+	for _, test := range []struct{ fn, typ, want string }{
+		{"pic.bin", "png", "pic.png"},
+		{"pic", "png", "pic.png"},
+		{"dir/pic.jpeg", "jpg", "dir/pic.jpg"},
+		{"dir.d/pic", "png", "dir.d/pic.png"},
+		{"a.b.c", "gif", "a.b.gif"},
+		{"trailing.", "png", "trailing.png"},
+		{".bashrc", "png", ".bashrc.png"},
+		{".hidden.bin", "png", ".hidden.png"},
+		{"dir/", "png", "dir/"},
+		{"", "png", ""},
+	} {
+		if got := NewName(test.fn, test.typ); got != test.want {
+			t.Errorf("NewName(%q, %q) = %q, want %q", test.fn, test.typ, got, test.want)
+		}
+	}
+}
+
+func FuzzNewName(f *testing.F) {
+	for _, fn := range []string{"pic.bin", "pic", "dir/pic.jpeg", ".bashrc", "trailing.", "a..b", "dir/", "..", "../x", "./.png"} {
+		f.Add(fn, "png")
+	}
+	f.Fuzz(func(t *testing.T, fn, typ string) {
+		if typ == "" || strings.ContainsAny(typ, `./\`) {
+			t.Skip() // not a type which Classify returns
+		}
+		got := NewName(fn, typ)
+		dir, base := filepath.Split(fn)
+		gotDir, gotBase := filepath.Split(got)
+		if gotDir != dir {
+			t.Errorf("NewName(%q, %q) = %q, which changes the directory", fn, typ, got)
+		}
+		if base != "" && (gotBase == "." || gotBase == "..") {
+			t.Errorf("NewName(%q, %q) = %q, which refers to a directory", fn, typ, got)
+		}
+		if again := NewName(got, typ); again != got {
+			t.Errorf("NewName(%q, %q) = %q, but NewName(%q, %q) = %q", fn, typ, got, got, typ, again)
+		}
+	})
+}
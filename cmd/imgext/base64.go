@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BranLwyd/imgext"
+)
+
+// maxBase64Size is the size of the largest file which --decode-base64 will
+// attempt to decode.
+const maxBase64Size = 64 << 20
+
+// decodeBase64 decodes base64-encoded data, such as an image stored as text,
+// which may be wrapped across lines and may be in the form of a data URI (e.g.
+// "data:image/png;base64,iVBOR...").
+func decodeBase64(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if strings.HasPrefix(s, "data:") {
+		i := strings.IndexByte(s, ',')
+		if i < 0 || !strings.HasSuffix(s[:i], ";base64") {
+			return nil, errors.New("not a base64 data URI")
+		}
+		s = s[i+1:]
+	}
+	s = strings.Join(strings.Fields(s), "")
+	dec, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		dec, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	return dec, err
+}
+
+// readBase64File reads & decodes the named base64-encoded file.
+func readBase64File(fn string) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open: %w", wrapVanished(err))
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(throttle(f), maxBase64Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read: %w", err)
+	}
+	if len(data) > maxBase64Size {
+		return nil, errors.New("file is too large to decode")
+	}
+	return decodeBase64(data)
+}
+
+// classifyBase64 determines the type of the image held base64-encoded in the
+// named file, per --decode-base64. ok is false if the file does not hold a
+// base64-encoded image.
+func classifyBase64(fn string) (typ string, ok bool) {
+	data, err := readBase64File(fn)
+	if err != nil || len(data) == 0 {
+		return "", false
+	}
+	typ, err = classifier.ClassifyBytes(data)
+	return typ, err == nil
+}
+
+// convertBase64 writes the decoded content of the base64-encoded image
+// described by res to its destination, per --convert (or just reports it, if
+// --dry_run is set), returning the updated result. The original file is left
+// in place.
+func convertBase64(res result) result {
+	if *dryRun {
+		res.Action = actionWouldConvert
+		return res
+	}
+	if err := func() error {
+		data, err := readBase64File(res.Path)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(res.Rename.To, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return fmt.Errorf("%w: %q", imgext.ErrDestinationExists, res.Rename.To)
+			}
+			return fmt.Errorf("couldn't create: %w", err)
+		}
+		if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+			f.Close()
+			os.Remove(res.Rename.To)
+			return fmt.Errorf("couldn't write: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(res.Rename.To)
+			return fmt.Errorf("couldn't write: %w", err)
+		}
+		if chmodFn != nil {
+			res.ChmodErr = applyChmod(res.Rename.To)
+		}
+		return nil
+	}(); err != nil {
+		res.Action, res.Err = actionError, err
+		return res
+	}
+	res.Action = actionConverted
+	return res
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/imgext"
+)
+
+func TestDecodeBase64(t *testing.T) {
+	enc := base64.StdEncoding.EncodeToString(pngData)
+	var wrapped strings.Builder
+	for s := enc; s != ""; {
+		n := min(len(s), 76)
+		wrapped.WriteString(s[:n] + "\r\n")
+		s = s[n:]
+	}
+	for _, test := range []struct {
+		name, in string
+		wantErr  bool
+	}{
+		{"plain", enc, false},
+		{"trailing newline", enc + "\n", false},
+		{"wrapped", wrapped.String(), false},
+		{"unpadded", strings.TrimRight(enc, "="), false},
+		{"data URI", "data:image/png;base64," + enc, false},
+		{"data URI with parameters", "data:image/png;name=pic.png;base64," + enc, false},
+		{"non-base64 data URI", "data:text/plain,hello", true},
+		{"not base64", "hello, world!", true},
+	} {
+		got, err := decodeBase64([]byte(test.in))
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("%s: decodeBase64 succeeded, want error", test.name)
+		case !test.wantErr && (err != nil || !bytes.Equal(got, pngData)):
+			t.Errorf("%s: decodeBase64 = %d bytes, %v; want the original %d bytes", test.name, len(got), err, len(pngData))
+		}
+	}
+}
+
+func TestBase64(t *testing.T) {
+	b64 := []byte("data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData) + "\n")
+
+	t.Run("report only", func(t *testing.T) {
+		setFlags(t, "decode-base64", "true")
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string][]byte{"pic.txt": b64, "notes.txt": textData})
+		_, results := run(t, dir)
+		for _, res := range results {
+			switch filepath.Base(res.Path) {
+			case "pic.txt":
+				if res.Action != actionBase64 || res.Type != "png" || res.Rename.To != filepath.Join(dir, "pic.png") {
+					t.Errorf("pic.txt: got action %v, type %q & rename %+v; want %v, %q & destination pic.png", res.Action, res.Type, res.Rename, actionBase64, "png")
+				}
+			case "notes.txt":
+				if res.Action != actionError || !errors.Is(res.Err, imgext.ErrUnsupportedFormat) {
+					t.Errorf("notes.txt: got action %v (err = %v), want an unsupported format error", res.Action, res.Err)
+				}
+			}
+		}
+		if got, want := listFiles(t, dir), []string{"notes.txt", "pic.txt"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("convert", func(t *testing.T) {
+		setFlags(t, "decode-base64", "true", "convert", "true")
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string][]byte{"pic.txt": b64})
+		st, _ := run(t, dir)
+		if st.renamed != 1 || st.errors != 0 {
+			t.Errorf("Got %d renamed & %d errors, want 1 & 0", st.renamed, st.errors)
+		}
+		// The original is left in place.
+		if got, want := listFiles(t, dir), []string{"pic.png", "pic.txt"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "pic.png")); err != nil || !bytes.Equal(got, pngData) {
+			t.Errorf("pic.png does not hold the decoded image (err = %v)", err)
+		}
+	})
+
+	t.Run("convert, destination exists", func(t *testing.T) {
+		setFlags(t, "decode-base64", "true", "convert", "true")
+		dir := t.TempDir()
+		otherPNG := append(append([]byte(nil), pngData...), "trailing"...)
+		writeFiles(t, dir, map[string][]byte{"pic.txt": b64, "pic.png": otherPNG})
+		_, results := run(t, dir)
+		for _, res := range results {
+			if filepath.Base(res.Path) == "pic.txt" && !errors.Is(res.Err, imgext.ErrDestinationExists) {
+				t.Errorf("pic.txt: got action %v (err = %v), want an error wrapping %v", res.Action, res.Err, imgext.ErrDestinationExists)
+			}
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "pic.png")); err != nil || !bytes.Equal(got, otherPNG) {
+			t.Errorf("pic.png has been overwritten (err = %v)", err)
+		}
+	})
+}
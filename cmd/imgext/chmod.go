@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chmodFn, if non-nil, computes the permissions given to each file touched,
+// per --chmod.
+var chmodFn func(os.FileMode) os.FileMode
+
+// parseChmod parses a --chmod mode, returning a function computing a file's
+// new permission bits from its current ones. The mode is either octal (e.g.
+// "0644"), or symbolic: a comma-separated list of clauses such as "u+rw",
+// "go-w" or "a=r", each of which is zero or more of u, g, o & a (all, the
+// default), then one of +, - or =, then zero or more of r, w & x.
+func parseChmod(s string) (func(os.FileMode) os.FileMode, error) {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("%q is not an octal mode between 0 and 0777", s)
+		}
+		return func(os.FileMode) os.FileMode { return os.FileMode(m) }, nil
+	}
+
+	type clause struct {
+		op         byte
+		who, perms os.FileMode // masks within 0777
+	}
+	var clauses []clause
+	for _, c := range strings.Split(s, ",") {
+		i := strings.IndexAny(c, "+-=")
+		if i < 0 {
+			return nil, fmt.Errorf("clause %q has no operator (+, - or =)", c)
+		}
+		var who os.FileMode
+		for _, r := range c[:i] {
+			switch r {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				return nil, fmt.Errorf("clause %q has unknown class %q", c, r)
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		var perms os.FileMode
+		for _, r := range c[i+1:] {
+			switch r {
+			case 'r':
+				perms |= 0444
+			case 'w':
+				perms |= 0222
+			case 'x':
+				perms |= 0111
+			default:
+				return nil, fmt.Errorf("clause %q has unknown permission %q", c, r)
+			}
+		}
+		clauses = append(clauses, clause{c[i], who, perms & who})
+	}
+	return func(m os.FileMode) os.FileMode {
+		for _, c := range clauses {
+			switch c.op {
+			case '+':
+				m |= c.perms
+			case '-':
+				m &^= c.perms
+			case '=':
+				m = m&^c.who | c.perms
+			}
+		}
+		return m
+	}, nil
+}
+
+// applyChmod sets the permissions of the named file per --chmod.
+func applyChmod(fn string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(fn, chmodFn(fi.Mode().Perm()))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseChmod(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		from, to os.FileMode
+	}{
+		{"0644", 0777, 0644},
+		{"600", 0444, 0600},
+		{"0", 0777, 0},
+		{"+r", 0200, 0644},
+		{"a+r", 0200, 0644},
+		{"u+rw", 0044, 0644},
+		{"go-w", 0666, 0644},
+		{"u=rwx", 0444, 0744},
+		{"u+rw,go-w", 0066, 0644},
+		{"ug=r,o=", 0777, 0440},
+		{"-x", 0755, 0644},
+		{"=", 0755, 0},
+	} {
+		fn, err := parseChmod(test.mode)
+		if err != nil {
+			t.Errorf("parseChmod(%q): %v", test.mode, err)
+			continue
+		}
+		if got := fn(test.from); got != test.to {
+			t.Errorf("parseChmod(%q) applied to %04o = %04o, want %04o", test.mode, test.from, got, test.to)
+		}
+	}
+
+	for _, mode := range []string{"", "0888", "01000", "u", "u+z", "q+r", "u+r,", "rw"} {
+		if _, err := parseChmod(mode); err == nil {
+			t.Errorf("parseChmod(%q) succeeded, want error", mode)
+		}
+	}
+}
+
+func TestChmod(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+	for _, test := range []struct {
+		name  string
+		flags []string
+		want  os.FileMode // of the renamed file
+	}{
+		{"octal", nil, 0600},
+		{"dry run", []string{"dry_run", "true"}, 0666},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, append([]string{"chmod", "0600"}, test.flags...)...)
+			fn, err := parseChmod(*chmodFlag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chmodFn = fn // as set by main
+			t.Cleanup(func() { chmodFn = nil })
+
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"pic.bin": pngData, "ok.png": pngData})
+			for _, name := range []string{"pic.bin", "ok.png"} {
+				if err := os.Chmod(filepath.Join(dir, name), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			st, _ := run(t, dir)
+			if st.chmodFailed != 0 {
+				t.Errorf("Got %d chmod failures, want 0", st.chmodFailed)
+			}
+			renamed := filepath.Join(dir, "pic.png")
+			if *dryRun {
+				renamed = filepath.Join(dir, "pic.bin")
+			}
+			for fn, want := range map[string]os.FileMode{
+				renamed: test.want,
+				// Files which are not renamed are not touched.
+				filepath.Join(dir, "ok.png"): 0666,
+			} {
+				fi, err := os.Stat(fn)
+				if err != nil {
+					t.Errorf("%s: %v", filepath.Base(fn), err)
+					continue
+				}
+				if got := fi.Mode().Perm(); got != want {
+					t.Errorf("%s: got mode %v, want %v", filepath.Base(fn), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChmodDryRunOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"pic.bin": pngData})
+	out, code := runMain(t, dir, nil, "--dry_run", "--chmod=u+rw,go-w", "pic.bin")
+	if code != 0 {
+		t.Errorf("Exit code = %d, want 0", code)
+	}
+	if want := "pic.bin -> pic.png\n  would chmod: u+rw,go-w\n"; !strings.Contains(out, want) {
+		t.Errorf("Output does not contain %q:\n%s", want, out)
+	}
+
+	if out, code := runMain(t, dir, nil, "--chmod=u+z", "pic.bin"); code != usageExitCode {
+		t.Errorf("With a bad mode: exit code = %d, want %d; output:\n%s", code, usageExitCode, out)
+	}
+}
+
+func TestChmodFailureReport(t *testing.T) {
+	// A file whose permissions could not be set is still reported as
+	// renamed, with the failure alongside.
+	var buf bytes.Buffer
+	rep := &csvReporter{w: csv.NewWriter(&buf)}
+	rep.report(result{Path: "pic.bin", Type: "png", Rename: &rename{From: "pic.bin", To: "pic.png"}, Action: actionRename, ChmodErr: errors.New("operation not permitted")})
+	if err := rep.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "pic.bin,pic.png,png,rename,couldn't chmod: operation not permitted\n"; got != want {
+		t.Errorf("Got CSV %q, want %q", got, want)
+	}
+}
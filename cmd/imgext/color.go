@@ -0,0 +1,34 @@
+package main
+
+import "os"
+
+// ANSI escape sequences used to color terminal output.
+const (
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+// stdoutColor & stderrColor are set if human-readable output written to the
+// corresponding stream should be colored.
+var stdoutColor, stderrColor bool
+
+// useColor determines whether output written to f should be colored: it must
+// be a terminal, and color must not be disabled via --no-color or the NO_COLOR
+// environment variable (see https://no-color.org).
+func useColor(f *os.File) bool {
+	if *noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps s in the given ANSI color if enabled is set.
+func paint(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return color + s + ansiReset
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BranLwyd/imgext"
+)
+
+// dedupeResolver chooses a new destination for a rename whose destination is
+// already taken, either by an existing file or by another planned rename. taken
+// reports whether a candidate destination is unavailable.
+type dedupeResolver func(r *rename, taken func(string) bool) (string, error)
+
+// dedupeResolvers holds the available --dedupe strategies, keyed by name.
+var dedupeResolvers = map[string]dedupeResolver{
+	"number": dedupeNumber,
+	"hash":   dedupeHash,
+	"subdir": dedupeSubdir,
+}
+
+// dedupe resolves colliding destinations among the renames in results using
+// resolve. Renames are considered in order; the first rename to claim a
+// destination keeps it. Renames which cannot be resolved are turned into
+// errors.
+func dedupe(results []result, resolve dedupeResolver) {
+	claimed := map[string]bool{}
+	for i := range results {
+		if results[i].Action != actionRename {
+			continue
+		}
+		r := results[i].Rename
+		taken := func(to string) bool {
+			if claimed[to] {
+				return true
+			}
+			toFI, err := os.Lstat(to)
+			if err != nil {
+				return false
+			}
+			fromFI, err := os.Lstat(r.From)
+			return err != nil || !os.SameFile(fromFI, toFI)
+		}
+		if taken(r.To) {
+			to, err := resolve(r, taken)
+			if err == nil && taken(to) {
+				err = fmt.Errorf("deduplicated destination %q: %w", to, imgext.ErrDestinationExists)
+			}
+			if err != nil {
+				results[i].Action, results[i].Rename, results[i].Err = actionError, nil, fmt.Errorf("couldn't dedupe destination %q: %w", r.To, err)
+				continue
+			}
+			r.To = to
+		}
+		claimed[r.To] = true
+	}
+}
+
+// dedupeNumber numbers the destination per --collision-format (by default,
+// appending "-1", "-2", etc to its stem) until an untaken destination is found.
+func dedupeNumber(r *rename, taken func(string) bool) (string, error) {
+	dir, base := filepath.Split(r.To)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; ; n++ {
+		name := strings.NewReplacer("{stem}", stem, "{n}", strconv.Itoa(n), "{ext}", ext).Replace(*collisionFormat)
+		if to := dir + name; !taken(to) {
+			return to, nil
+		}
+	}
+}
+
+// dedupeHash appends a short hash of the source's content to the
+// destination's stem.
+func dedupeHash(r *rename, _ func(string) bool) (string, error) {
+	f, err := os.Open(r.From)
+	if err != nil {
+		return "", fmt.Errorf("couldn't open: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, throttle(f)); err != nil {
+		return "", fmt.Errorf("couldn't read: %w", err)
+	}
+	ext := filepath.Ext(r.To)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.To, ext), hex.EncodeToString(h.Sum(nil))[:8], ext), nil
+}
+
+// dedupeSubdir recreates the source's directory, relative to the current
+// working directory, under --dest-dir. Sources outside the current working
+// directory use their absolute directory instead.
+func dedupeSubdir(r *rename, _ func(string) bool) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(r.From))
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve source directory: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get working directory: %w", err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(dir[len(filepath.VolumeName(dir)):], string(filepath.Separator))
+	}
+	return filepath.Join(*destDir, rel, filepath.Base(r.To)), nil
+}
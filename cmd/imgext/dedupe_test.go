@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	// Two sources with the same name, and different content, in different
+	// directories.
+	otherPNG := append(append([]byte(nil), pngData...), "trailing"...)
+	sources := map[string][]byte{"a/photo.bin": pngData, "b/photo.bin": otherPNG}
+	sum := sha256.Sum256(otherPNG)
+	hash := hex.EncodeToString(sum[:])[:8]
+
+	for _, test := range []struct {
+		strategy string
+		flags    []string
+		existing map[string][]byte // files already in the destination directory
+		want     func(srcDir string) []string
+	}{
+		{
+			strategy: "number",
+			want:     func(string) []string { return []string{"photo-1.png", "photo.png"} },
+		},
+		{
+			strategy: "number",
+			existing: map[string][]byte{"photo.png": gifData},
+			want:     func(string) []string { return []string{"photo-1.png", "photo-2.png", "photo.png"} },
+		},
+		{
+			strategy: "number",
+			flags:    []string{"collision-format", "{stem} ({n}){ext}"},
+			want:     func(string) []string { return []string{"photo (1).png", "photo.png"} },
+		},
+		{
+			strategy: "hash",
+			want:     func(string) []string { return []string{"photo-" + hash + ".png", "photo.png"} },
+		},
+		{
+			strategy: "subdir",
+			want: func(srcDir string) []string {
+				// The sources are outside the working directory, so their
+				// absolute directory is recreated.
+				dir := filepath.Join(srcDir, "b")
+				dir = strings.TrimPrefix(dir[len(filepath.VolumeName(dir)):], string(filepath.Separator))
+				return []string{filepath.ToSlash(filepath.Join(dir, "photo.png")), "photo.png"}
+			},
+		},
+	} {
+		t.Run(test.strategy, func(t *testing.T) {
+			srcDir, destDir := t.TempDir(), t.TempDir()
+			writeFiles(t, srcDir, sources)
+			writeFiles(t, destDir, test.existing)
+			setFlags(t, append([]string{"dest-dir", destDir, "dedupe", test.strategy}, test.flags...)...)
+			st, _ := run(t, srcDir)
+			if st.renamed != 2 || st.errors != 0 {
+				t.Errorf("Got %d renamed & %d errors, want 2 & 0", st.renamed, st.errors)
+			}
+			want := test.want(srcDir)
+			slices.Sort(want)
+			if got := listFiles(t, destDir); !slices.Equal(got, want) {
+				t.Errorf("Destination files = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDedupeUnset(t *testing.T) {
+	srcDir, destDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string][]byte{"a/photo.bin": pngData, "b/photo.bin": pngData})
+	setFlags(t, "dest-dir", destDir)
+	st, _ := run(t, srcDir)
+	if st.renamed != 1 || st.errors != 1 {
+		t.Errorf("Got %d renamed & %d errors, want 1 & 1", st.renamed, st.errors)
+	}
+	if got, want := listFiles(t, srcDir), []string{"b/photo.bin"}; !slices.Equal(got, want) {
+		t.Errorf("Source files = %q, want %q", got, want)
+	}
+	if got, want := listFiles(t, destDir), []string{"photo.png"}; !slices.Equal(got, want) {
+		t.Errorf("Destination files = %q, want %q", got, want)
+	}
+}
+
+func TestCollisionFormatValidation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  []string
+		args []string
+		want string
+	}{
+		{"missing {n}", nil, []string{"--dedupe=number", "--collision-format={stem}{ext}"}, "must contain {n}"},
+		{"slash", nil, []string{"--dedupe=number", "--collision-format=dup/{stem}-{n}{ext}"}, "must not contain path separators"},
+		{"backslash", nil, []string{"--dedupe=number", `--collision-format={stem}\{n}{ext}`}, "must not contain path separators"},
+		{"without --dedupe", nil, []string{"--collision-format={stem} ({n}){ext}"}, "requires --dedupe=number"},
+		{"with another strategy", nil, []string{"--dedupe=hash", "--collision-format={stem} ({n}){ext}"}, "requires --dedupe=number"},
+		{"from the environment", []string{"IMGEXT_COLLISION_FORMAT={stem} ({n}){ext}"}, nil, "requires --dedupe=number"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"a.bin": pngData})
+			out, code := runMain(t, dir, test.env, append(test.args, "a.bin")...)
+			if code != usageExitCode || !strings.Contains(out, test.want) {
+				t.Errorf("Got exit code %d with output %q, want %d with output containing %q", code, out, usageExitCode, test.want)
+			}
+			if got, want := listFiles(t, dir), []string{"a.bin"}; !slices.Equal(got, want) {
+				t.Errorf("Files afterward = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// A valid format is accepted.
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "a.png": gifData})
+	if out, code := runMain(t, dir, nil, "--dedupe=number", "--collision-format={stem}_{n}{ext}", "a.bin"); code != 0 {
+		t.Errorf("Got exit code %d with output %q, want 0", code, out)
+	}
+	if got, want := listFiles(t, dir), []string{"a.png", "a_1.png"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
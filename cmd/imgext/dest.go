@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// destPath returns the path to which fn should be moved under --dest-dir,
+// given that its corrected name is newFN. In "mirror" mode, fn's directory
+// relative to --source-root is recreated under --dest-dir.
+func destPath(fn, newFN string) (string, error) {
+	if *outputStructure != "mirror" {
+		return filepath.Join(*destDir, filepath.Base(newFN)), nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve directory: %w", err)
+	}
+	rel, err := filepath.Rel(*sourceRoot, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file is not under source root %q", *sourceRoot)
+	}
+	return filepath.Join(*destDir, rel, filepath.Base(newFN)), nil
+}
+
+// commonGlobRoot returns the deepest directory containing every file which
+// could be matched by the given globs, as an absolute path.
+func commonGlobRoot(globs []string) (string, error) {
+	var root []string
+	for i, glob := range globs {
+		dir, err := filepath.Abs(globRoot(glob))
+		if err != nil {
+			return "", fmt.Errorf("couldn't resolve %q: %w", glob, err)
+		}
+		elems := strings.Split(dir, string(filepath.Separator))
+		if i == 0 {
+			root = elems
+			continue
+		}
+		n := 0
+		for n < len(root) && n < len(elems) && root[n] == elems[n] {
+			n++
+		}
+		root = root[:n]
+	}
+	if len(root) == 1 && root[0] == "" {
+		return string(filepath.Separator), nil
+	}
+	return strings.Join(root, string(filepath.Separator)), nil
+}
+
+// globRoot returns the directory made up of the leading path elements of glob
+// which contain no pattern metacharacters.
+func globRoot(glob string) string {
+	magic := "*?["
+	if runtime.GOOS != "windows" {
+		magic += `\`
+	}
+	sep := string(filepath.Separator)
+	elems := strings.Split(filepath.Clean(glob), sep)
+	for i, elem := range elems {
+		if !strings.ContainsAny(elem, magic) {
+			continue
+		}
+		switch root := strings.Join(elems[:i], sep); {
+		case root != "":
+			return root
+		case filepath.IsAbs(glob):
+			return sep
+		default:
+			return "."
+		}
+	}
+	return filepath.Dir(glob)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDestDir(t *testing.T) {
+	files := map[string][]byte{"a.bin": pngData, "sub/b.dat": gifData, "sub/deep/c.jpeg": jpegData}
+	for _, test := range []struct {
+		name      string
+		structure string
+		root      string // relative to the source directory
+		wantSrc   []string
+		wantDest  []string
+		errors    int
+	}{
+		{
+			name:      "flat",
+			structure: "flat",
+			wantDest:  []string{"a.png", "b.gif", "c.jpg"},
+		},
+		{
+			name:      "mirror",
+			structure: "mirror",
+			root:      ".",
+			wantDest:  []string{"a.png", "sub/b.gif", "sub/deep/c.jpg"},
+		},
+		{
+			// Files outside the source root are not moved.
+			name:      "mirror of a subdirectory",
+			structure: "mirror",
+			root:      "sub",
+			wantSrc:   []string{"a.bin"},
+			wantDest:  []string{"b.gif", "deep/c.jpg"},
+			errors:    1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src, dest := t.TempDir(), t.TempDir()
+			setFlags(t, "dest-dir", dest, "output-dir-structure", test.structure)
+			if test.root != "" {
+				setFlags(t, "source-root", filepath.Join(src, test.root))
+			}
+			writeFiles(t, src, files)
+			st, results := run(t, src)
+			if st.errors != test.errors {
+				t.Errorf("Got %d errors, want %d", st.errors, test.errors)
+			}
+			for _, res := range results {
+				if res.Err != nil && !strings.Contains(res.Err.Error(), "file is not under source root") {
+					t.Errorf("%s: unexpected error %v", res.Path, res.Err)
+				}
+			}
+			if got := listFiles(t, src); !slices.Equal(got, test.wantSrc) {
+				t.Errorf("Source files afterward = %q, want %q", got, test.wantSrc)
+			}
+			if got := listFiles(t, dest); !slices.Equal(got, test.wantDest) {
+				t.Errorf("Destination files afterward = %q, want %q", got, test.wantDest)
+			}
+		})
+	}
+}
+
+func TestDestDirMirrorDefaultRoot(t *testing.T) {
+	// Without --source-root, the deepest directory common to the globs is
+	// mirrored.
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"src/x/a.bin": pngData, "src/y/b.dat": gifData})
+	out, code := runMain(t, dir, nil, "--dest-dir=out", "--output-dir-structure=mirror", "src/x/*", "src/y/*")
+	if code != 0 {
+		t.Fatalf("imgext exited with code %d: %s", code, out)
+	}
+	if got, want := listFiles(t, filepath.Join(dir, "out")), []string{"x/a.png", "y/b.gif"}; !slices.Equal(got, want) {
+		t.Errorf("Destination files afterward = %q, want %q", got, want)
+	}
+}
+
+func TestCommonGlobRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+	abs := func(p string) string { return filepath.Join(wd, filepath.FromSlash(p)) }
+	for _, test := range []struct {
+		globs []string
+		want  string
+	}{
+		{[]string{"a/b/*.png"}, abs("a/b")},
+		{[]string{"a/b/*.png", "a/c/*.jpg"}, abs("a")},
+		{[]string{"a/b/*/*.png", "a/b/c/d.png"}, abs("a/b")},
+		{[]string{"a/b*/c/*.png"}, abs("a")},
+		{[]string{"*.png"}, wd},
+		{[]string{"a/*.png", "*/x.png"}, wd},
+		{[]string{"/x/y/*.png", "/x/z/*.png"}, filepath.FromSlash("/x")},
+		{[]string{"/x/*.png", "/y/*.png"}, sep},
+	} {
+		var globs []string
+		for _, g := range test.globs {
+			globs = append(globs, filepath.FromSlash(g))
+		}
+		if got, err := commonGlobRoot(globs); got != test.want || err != nil {
+			t.Errorf("commonGlobRoot(%q) = %q, %v; want %q, nil", test.globs, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables providing flag defaults.
+const envPrefix = "IMGEXT_"
+
+// envName returns the name of the environment variable providing the default
+// for the named flag, e.g. IMGEXT_DRY_RUN for --dry_run.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvDefaults sets flags from the corresponding environment variables. It
+// must be called before flag.Parse, so that flags given on the command line
+// take precedence. Unrecognized IMGEXT_ variables are warned about, since
+// they are most likely typos.
+func applyEnvDefaults() error {
+	known := map[string]bool{}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "help" || f.Name == "h" {
+			return
+		}
+		name := envName(f.Name)
+		known[name] = true
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(v); setErr != nil {
+			err = fmt.Errorf("bad value %q for %s: %w", v, name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, envPrefix) && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring unrecognized environment variable %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  []string
+		args []string
+		want []string // files afterward
+	}{
+		{"default", nil, nil, []string{"pic.png"}},
+		{"env", []string{"IMGEXT_DRY_RUN=true"}, nil, []string{"pic.bin"}},
+		{"flag over env", []string{"IMGEXT_DRY_RUN=true"}, []string{"--dry_run=false"}, []string{"pic.png"}},
+		{"flag over default", nil, []string{"--dry_run"}, []string{"pic.bin"}},
+		{"dashed name", []string{"IMGEXT_DEST_DIR=out"}, nil, []string{"out/pic.png"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"pic.bin": pngData})
+			out, code := runMain(t, dir, test.env, append(test.args, "pic.bin")...)
+			if code != 0 {
+				t.Errorf("Exit code = %d, want 0; output:\n%s", code, out)
+			}
+			if got := listFiles(t, dir); !slices.Equal(got, test.want) {
+				t.Errorf("Files afterward = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"pic.bin": pngData})
+
+	out, code := runMain(t, dir, []string{"IMGEXT_CONCURRENCY=lots"}, "pic.bin")
+	if code != usageExitCode || !strings.Contains(out, "IMGEXT_CONCURRENCY") {
+		t.Errorf("With a bad value: exit code = %d, want %d; output:\n%s", code, usageExitCode, out)
+	}
+
+	out, code = runMain(t, dir, []string{"IMGEXT_DRYRUN=true"}, "--dry_run", "pic.bin")
+	if code != 0 || !strings.Contains(out, "Warning: ignoring unrecognized environment variable IMGEXT_DRYRUN") {
+		t.Errorf("With an unknown variable: exit code = %d, want 0; output:\n%s", code, out)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// glob returns the names of all files matching pattern, as filepath.Glob
+// does, but matching case-insensitively if --glob-case-insensitive is set.
+func glob(pattern string) ([]string, error) {
+	if !*globFold {
+		return filepath.Glob(pattern)
+	}
+	return globCaseInsensitive(pattern)
+}
+
+// globCaseInsensitive is like filepath.Glob, but every element of pattern,
+// including those without wildcards, matches names case-insensitively. It
+// walks the pattern one path element at a time, listing each candidate
+// directory and matching lower-cased names against the lower-cased element.
+// Like filepath.Glob, it ignores I/O errors such as unreadable directories.
+func globCaseInsensitive(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	vol := filepath.VolumeName(pattern)
+	rest := pattern[len(vol):]
+	root := vol
+	if len(rest) > 0 && os.IsPathSeparator(rest[0]) {
+		root += string(filepath.Separator)
+	}
+	elems := strings.FieldsFunc(rest, func(r rune) bool { return r < 0x80 && os.IsPathSeparator(uint8(r)) })
+
+	matches := []string{root}
+	for _, elem := range elems {
+		var next []string
+		for _, dir := range matches {
+			if elem == "." || elem == ".." {
+				next = append(next, joinGlob(dir, elem))
+				continue
+			}
+			listDir := dir
+			if listDir == "" {
+				listDir = "."
+			}
+			entries, err := os.ReadDir(listDir)
+			if err != nil {
+				continue
+			}
+			lowerElem := strings.ToLower(elem)
+			for _, e := range entries {
+				if ok, _ := filepath.Match(lowerElem, strings.ToLower(e.Name())); ok {
+					next = append(next, joinGlob(dir, e.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	if len(elems) == 0 || os.IsPathSeparator(pattern[len(pattern)-1]) {
+		return nil, nil // as with filepath.Glob, nothing matches these
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// joinGlob joins a directory matched by globCaseInsensitive (which may be "",
+// for the current directory, or a root) with a name within it.
+func joinGlob(dir, name string) string {
+	switch {
+	case dir == "":
+		return name
+	case os.IsPathSeparator(dir[len(dir)-1]):
+		return dir + name
+	default:
+		return dir + string(filepath.Separator) + name
+	}
+}
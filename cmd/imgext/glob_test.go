@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestGlobCaseInsensitive(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"Photos/IMG_1.JPG":    nil,
+		"Photos/img_2.jpeg":   nil,
+		"Photos/Notes.txt":    nil,
+		"photos2/x.png":       nil,
+		"Other/a.PNG":         nil,
+		"Other/Deep/b.Png":    nil,
+		"Other/Deep/c.jpeg":   nil,
+		"Other/Deepest/d.PnG": nil,
+	})
+	sep := string(filepath.Separator)
+	for _, test := range []struct {
+		name    string
+		pattern string // relative to dir, with slashes
+		want    []string
+	}{
+		{"literal directory", "photos/*.jpg", []string{"Photos/IMG_1.JPG"}},
+		{"upper-case pattern", "PHOTOS/IMG_*", []string{"Photos/IMG_1.JPG", "Photos/img_2.jpeg"}},
+		{"literal file", "other/A.png", []string{"Other/a.PNG"}},
+		{"character class", "photos/img_[0-9].JP*", []string{"Photos/IMG_1.JPG", "Photos/img_2.jpeg"}},
+		{"upper-case character class", "[O]THER/*", []string{"Other/Deep", "Other/Deepest", "Other/a.PNG"}},
+		{"wildcard directory", "other/*/*.png", []string{"Other/Deep/b.Png", "Other/Deepest/d.PnG"}},
+		{"question mark", "PHOTOS?/*", []string{"photos2/x.png"}},
+		{"dot-dot element", "photos/../OTHER/*.png", []string{"Photos/../Other/a.PNG"}},
+		{"no match", "photos/*.gif", nil},
+		{"trailing separator", "photos/", nil},
+	} {
+		got, err := globCaseInsensitive(dir + sep + filepath.FromSlash(test.pattern))
+		if err != nil {
+			t.Errorf("%s: globCaseInsensitive error: %v", test.name, err)
+			continue
+		}
+		var want []string
+		for _, w := range test.want {
+			want = append(want, dir+sep+filepath.FromSlash(w))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: globCaseInsensitive(%q) = %q, want %q", test.name, test.pattern, got, want)
+		}
+	}
+
+	// An absolute pattern with a wildcard in its first element.
+	if got, err := globCaseInsensitive(sep + "*"); err != nil || len(got) == 0 {
+		t.Errorf("globCaseInsensitive(%q) = %q, %v; want a non-empty list", sep+"*", got, err)
+	}
+	// Bad patterns are reported, as by filepath.Glob.
+	if _, err := globCaseInsensitive(dir + sep + "[a-"); err != filepath.ErrBadPattern {
+		t.Errorf("globCaseInsensitive(bad pattern) error = %v, want %v", err, filepath.ErrBadPattern)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"Photos/IMG_1.JPG": nil})
+	pattern := filepath.Join(dir, "photos", "*.jpg")
+	for _, fold := range []bool{false, true} {
+		setFlags(t, "glob-case-insensitive", fmt.Sprint(fold))
+		got, err := glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if fold {
+			want = []string{filepath.Join(dir, "Photos", "IMG_1.JPG")}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("glob with --glob-case-insensitive=%t = %q, want %q", fold, got, want)
+		}
+	}
+}
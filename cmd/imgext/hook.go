@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// hookArgs returns the --exec command for the given rename, with the {old} &
+// {new} placeholders substituted. The command is split on whitespace before
+// substitution, and is not passed through a shell.
+func hookArgs(r *rename) []string {
+	args := strings.Fields(*execHook)
+	for i, arg := range args {
+		args[i] = strings.NewReplacer("{old}", r.From, "{new}", r.To).Replace(arg)
+	}
+	return args
+}
+
+// hookRunner runs --exec hooks with bounded concurrency.
+type hookRunner struct {
+	wg       sync.WaitGroup
+	sem      chan struct{}
+	failures int64 // accessed atomically
+}
+
+func newHookRunner(concurrency int) *hookRunner {
+	return &hookRunner{sem: make(chan struct{}, concurrency)}
+}
+
+// run starts the given hook command, blocking only while the maximum number of
+// hooks are already running. A failure is reported, along with the command's
+// stderr, and counted.
+func (h *hookRunner) run(path string, args []string) {
+	h.sem <- struct{}{}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.sem }()
+		var stderr bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stderr, &stderr
+		if err := cmd.Run(); err != nil {
+			atomic.AddInt64(&h.failures, 1)
+			fmt.Fprintf(os.Stderr, "Hook for %q failed: %v\n%s", path, err, stderr.Bytes())
+		}
+	}()
+}
+
+// wait waits for all started hooks to finish, returning the number which
+// failed.
+func (h *hookRunner) wait() int {
+	h.wg.Wait()
+	return int(atomic.LoadInt64(&h.failures))
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BranLwyd/imgext"
+)
+
+var (
+	dryRun          = flag.Bool("dry_run", false, "If set, do not rename files, just print what renames would occur.")
+	concurrency     = flag.Int("concurrency", 0, "The number of files to process at once. If unset, a reasonable value will be chosen automatically.")
+	jsonOutput      = flag.Bool("json", false, "If set along with --dry_run, print the plan as a single JSON document rather than as human-readable text.")
+	planHash        = flag.Bool("plan-hash", false, "If set, do not rename files; instead, print a hash of the planned renames. The hash depends only on the sources & destinations of the renames.")
+	assertEmpty     = flag.Bool("assert-empty", false, "If set along with --plan-hash, exit with a non-zero status if any renames are planned.")
+	applyPlan       = flag.String("apply-plan", "", "If set, execute the renames in the given plan file (as produced by --dry_run --json) rather than searching for files.")
+	nonImages       = flag.Bool("include-non-images", false, "If set, files which are not recognized as images are classified by their MIME type, as detected by Go's net/http package, so that e.g. PDFs & plain text files are also given the correct extension. Files whose extension is already one used for the detected type (e.g. .docx for a ZIP archive, or .csv for plain text) are left as is.")
+	raw             = flag.Bool("raw", false, "If set, recognize RAW camera formats (CR2, NEF, ARW, etc.) by their headers. These heuristics may be imperfect.")
+	batchByDir      = flag.Bool("batch-by-dir", false, "If set, files are classified one directory at a time: all files in a directory are finished before any in the next are started. This may reduce metadata contention on some filesystems, at the cost of idle workers at the end of each directory.")
+	typeConc        = flag.String("type-concurrency", "", "A comma-separated list of ext:N pairs limiting how many files with each extension are processed at once, e.g. \"tiff:1,default:8\". The \"default\" entry limits all unlisted extensions together. Limits are keyed on each file's current extension, as a proxy for its type, which is not known until the file is read; extensions of the same type (e.g. tif & tiff) share a limit. Files held at their limit are set aside, so that files of other types are not held up behind them.")
+	destDir         = flag.String("dest-dir", "", "If set, move files into this directory (which must be on the same filesystem) rather than renaming them in place.")
+	outputStructure = flag.String("output-dir-structure", "flat", "How files are laid out under --dest-dir: \"flat\" places every file directly in --dest-dir; \"mirror\" recreates each file's directory relative to --source-root.")
+	sourceRoot      = flag.String("source-root", "", "The directory relative to which source directories are recreated by --output-dir-structure=mirror. If unset, the deepest directory common to all globs is used.")
+	dedupeFlag      = flag.String("dedupe", "", "If set, the strategy used to resolve destinations which collide with an existing file or another rename: \"number\" appends -1, -2, etc; \"hash\" appends a short content hash; \"subdir\" recreates the source's directory under --dest-dir.")
+	collisionFormat = flag.String("collision-format", "{stem}-{n}{ext}", "The template for destinations numbered by --dedupe=number, e.g. \"{stem} ({n}){ext}\". {stem} is replaced by the destination's name without its extension, {n} by 1, 2, etc, and {ext} by its extension, including the leading dot. It must contain {n}, and requires --dedupe=number.")
+	apngExt         = flag.String("apng-ext", "", "If set, the extension given to animated PNGs (APNGs). By default, APNGs are treated like any other PNG.")
+	unicodeForm     = flag.String("normalize-unicode", "", "If set, the Unicode normalization form, \"nfc\" or \"nfd\", to which the names of files (excluding their directory & extension) are converted. Files whose names differ from the normalized form are renamed even if their extension is correct, e.g. so that names read on macOS match a catalog expecting NFC.")
+	stripDelims     = flag.String("strip-query-and-fragment", "", "If set, a set of delimiter characters, e.g. \"?#@\". When a file is renamed, everything from the first of these in its name onward is stripped before the correct extension is applied, so that e.g. \"image.php?id=5.jpg\" becomes \"image.jpg\" and \"photo.jpg@2x\" becomes \"photo.jpg\".")
+	candidates      = flag.String("candidates", "", "If set, a comma-separated list of extensions, e.g. \"bin,dat,img\". Only files with these extensions are read & classified; all others are assumed to be correctly named.")
+	checkFullDecode = flag.Bool("check-full-decode", false, "If set, fully decode each image whose type is detected, and report those which are truncated or otherwise corrupt despite a valid header. This is much more expensive than normal detection, which reads only as far as the image dimensions.")
+	noFullDecode    = flag.Bool("no-full-decode", false, "If set, image formats supported by the built-in decoders are recognized by their signature alone, reading only the start of each file rather than everything up to the image dimensions. Files which are corrupt past their signature will not be noticed.")
+	trustKnownExts  = flag.Bool("trust-known-extensions", false, "If set, files whose extension is a recognized image extension are assumed to be correct, and are not read. This greatly reduces I/O when most files are correctly named, at the cost of not noticing files with a plausible but incorrect extension.")
+	onlyIfInvalid   = flag.Bool("rename-only-if-invalid", false, "If set, only files whose extension is not a recognized image extension (e.g. .bin, .dat, or no extension at all) are renamed. Files with an image extension are left untouched, even if it is the wrong one, and are not read. This is equivalent to --trust-known-extensions, differing only in the reason reported for skipped files: use whichever describes the intent of the run.")
+	warnMismatch    = flag.Bool("warn-mismatch", false, "If set, warn about files whose extension belongs to one image type but whose content is a different image type.")
+	globFold        = flag.Bool("glob-case-insensitive", false, "If set, glob patterns match file & directory names case-insensitively, e.g. \"*.JPG\" matches photo.jpg.")
+	globErrOK       = flag.Bool("continue-on-glob-error", false, "If set, bad glob patterns are reported & skipped, rather than aborting the run.")
+	maxErrors       = flag.Int("max-errors", 0, "If positive, the run is aborted once this many errors have been encountered. If unset, there is no limit.")
+	maxReadRate     = flag.Int64("max-read-bytes-per-sec", 0, "If positive, the aggregate rate, in bytes per second, at which file contents are read across all workers. If unset, reads are not limited.")
+	execHook        = flag.String("exec", "", "If set, a command to run after each successful rename, e.g. \"convert {new} {new}.thumb.jpg\". The command is split on whitespace, then {old} & {new} are replaced by the file's old & new paths; it is not run by a shell. In --dry_run, the commands are printed instead.")
+	statusLine      = flag.Bool("status-line", false, "If set, finish with a single machine-parseable line of the form \"STATUS renamed=N skipped=N errors=N duration=D\". It is written to stdout, or to stderr if stdout holds a --json or --report document.")
+	relativeTo      = flag.String("relative-to", "", "If set, paths are reported relative to this directory. This only affects output; files are still handled via their real paths.")
+	renameStrategy  = flag.String("rename-strategy", "move", "How files are placed at their new paths: \"move\" renames them; \"link\" hard-links them, leaving the original in place; \"reflink\" makes a copy-on-write clone (on Linux filesystems which support it, e.g. btrfs & XFS), leaving the original in place. Where links or clones are not supported, files are copied instead, with a warning.")
+	chmodFlag       = flag.String("chmod", "", "If set, the permissions given to each file renamed (or written by --convert), either octal (e.g. \"0644\") or symbolic (e.g. \"u+rw,go-w\"). With --rename-strategy=link, the original shares the new file's permissions. In --dry_run, the intended change is printed instead.")
+	removeOriginal  = flag.Bool("remove-original", false, "If set along with --rename-strategy=link or reflink, remove each original once it has been placed at its new path.")
+	resume          = flag.String("resume", "", "If set, a state file recording each file once it has been handled (renamed, or found to be correct). Files recorded by a previous run with the same state file are skipped, so that an interrupted run may be resumed. Ignored with --dry_run.")
+	decodeB64       = flag.Bool("decode-base64", false, "If set, files which are not images are checked for base64-encoded images (optionally as data URIs, e.g. \"data:image/png;base64,...\"), and those found are reported. They are not renamed, since their content is text, not an image.")
+	convert         = flag.Bool("convert", false, "If set along with --decode-base64, write the decoded content of each base64-encoded image to a new file with the correct extension, leaving the original in place.")
+	removeEmpty     = flag.Bool("remove-empty", false, "If set, remove empty (zero-byte) files, such as those left by interrupted downloads. By default, they are reported & skipped.")
+	transactional   = flag.Bool("transactional", false, "If set, renames are all-or-nothing: if any rename fails, no further renames are attempted and those already performed are undone. --exec hooks are only run once every rename has succeeded. Directories created under --dest-dir are left in place.")
+	renameLogPath   = flag.String("rename-log", "", "If set, append a timestamped line for each rename performed to this file, creating it if necessary. Each line holds the time, old path & new path, separated by tabs.")
+	logMaxSize      = flag.Int64("log-max-size", 0, "If positive, the --rename-log file is rotated (to the same name with \".1\" appended, replacing any previous such file) before it would exceed this many bytes.")
+	summaryJSON     = flag.String("summary-json", "", "If set, write a JSON document summarizing the run to this file after the run: the number of files found & renamed, the number skipped (broken down by reason), the files which could not be handled, and the run's duration.")
+	formatStats     = flag.String("format-stats", "", "If set, write metrics describing the run to this file after the run, in the Prometheus text format (e.g. for node_exporter's textfile collector).")
+	verbose         = flag.Bool("verbose", false, "If set, also report each file which is left unchanged, and why.")
+	noColor         = flag.Bool("no-color", false, "If set, never color output. By default, text output is colored when written to a terminal, unless the NO_COLOR environment variable is set.")
+	reportFormat    = flag.String("report", "text", "The format in which to report results: \"text\", or \"csv\" for a CSV document with one row per file.")
+	help            = flag.Bool("help", false, "If set, print usage information and exit.")
+
+	start = time.Now()
+
+	// classifier classifies files, per the flags enabling optional formats.
+	classifier imgext.Classifier
+
+	// typeExts maps from each type, as returned by classifier, to the
+	// extensions commonly used for files of that type. Some types are listed
+	// only so that their extensions are recognized as image extensions.
+	typeExts = map[string][]string{
+		"jpg":  {"jpg", "jpeg", "jpe", "jfif"},
+		"png":  {"png"},
+		"gif":  {"gif"},
+		"tiff": {"tif", "tiff"},
+		"bmp":  {"bmp"},
+		"webp": {"webp"},
+		"jxl":  {"jxl"},
+		"cr2":  {"cr2"},
+		"cr3":  {"cr3"},
+		"nef":  {"nef"},
+		"arw":  {"arw"},
+		"pef":  {"pef"},
+		"srw":  {"srw"},
+		"orf":  {"orf"},
+		"rw2":  {"rw2"},
+		"raf":  {"raf"},
+		"dng":  {"dng"},
+	}
+
+	// candidateExts holds the extensions listed by --candidates, lower-cased &
+	// without a leading dot, or is nil if --candidates is unset.
+	candidateExts map[string]bool
+
+	// typeSems holds a semaphore per type listed in --type-concurrency, keyed
+	// by typeKey; the semaphore for all other types, if any, is keyed by
+	// "default".
+	typeSems = map[string]chan struct{}{}
+
+	// typeFreed receives a value (if it has room) whenever a typeSems
+	// semaphore is released, so that files held back by makePlan may be
+	// retried.
+	typeFreed = make(chan struct{}, 1)
+)
+
+// usageExitCode is the exit code used for usage errors, to distinguish them
+// from errors encountered while processing files.
+const usageExitCode = 2
+
+// maxResponseFileDepth is the maximum depth to which @file arguments may be
+// nested.
+const maxResponseFileDepth = 16
+
+func init() {
+	flag.BoolVar(help, "h", false, "Shorthand for --help.")
+	flag.Usage = func() { usage(os.Stderr) }
+}
+
+func main() {
+	// Parse & validate flags.
+	if err := applyEnvDefaults(); err != nil {
+		dieUsage("Bad environment: %v", err)
+	}
+	flag.Parse()
+	if *help {
+		usage(os.Stdout)
+		os.Exit(0)
+	}
+	switch {
+	case *concurrency == 0:
+		*concurrency = runtime.GOMAXPROCS(0)
+	case *concurrency < 0:
+		dieUsage("The --concurrency flag must be non-negative.")
+	}
+	switch {
+	case *maxReadRate > 0:
+		readLimiter = newRateLimiter(*maxReadRate)
+	case *maxReadRate < 0:
+		dieUsage("The --max-read-bytes-per-sec flag must be non-negative.")
+	}
+	if *logMaxSize < 0 {
+		dieUsage("The --log-max-size flag must be non-negative.")
+	}
+	if *renameLogPath != "" {
+		renameLogger = newRenameLog(*renameLogPath, *logMaxSize)
+	}
+	if *maxErrors < 0 {
+		dieUsage("The --max-errors flag must be non-negative.")
+	}
+	if _, ok := renameStrategies[*renameStrategy]; !ok {
+		dieUsage("Bad --rename-strategy flag: unknown strategy %q", *renameStrategy)
+	}
+	if *chmodFlag != "" {
+		var err error
+		if chmodFn, err = parseChmod(*chmodFlag); err != nil {
+			dieUsage("Bad --chmod flag: %v", err)
+		}
+	}
+	if *convert && !*decodeB64 {
+		dieUsage("The --convert flag requires --decode-base64.")
+	}
+	if *removeOriginal && *renameStrategy == "move" {
+		dieUsage("The --remove-original flag requires --rename-strategy=link or reflink.")
+	}
+	if *execHook != "" && len(strings.Fields(*execHook)) == 0 {
+		dieUsage("The --exec flag must not be blank.")
+	}
+	if *relativeTo != "" {
+		base, err := filepath.Abs(*relativeTo)
+		if err != nil {
+			dieUsage("Bad --relative-to flag: %v", err)
+		}
+		*relativeTo = base
+	}
+	*apngExt = strings.TrimPrefix(*apngExt, ".")
+	if _, ok := unicodeForms[*unicodeForm]; *unicodeForm != "" && !ok {
+		dieUsage("Bad --normalize-unicode flag: unknown form %q", *unicodeForm)
+	}
+	if strings.ContainsAny(*stripDelims, `/\`) {
+		dieUsage("The --strip-query-and-fragment flag must not contain path separators.")
+	}
+	if strings.ContainsAny(*apngExt, `/\`) {
+		dieUsage("The --apng-ext flag must not contain path separators.")
+	}
+	classifier = imgext.Classifier{RAW: *raw, SignatureOnly: *noFullDecode, NonImages: *nonImages, APNGExt: *apngExt}
+	stdoutColor, stderrColor = useColor(os.Stdout), useColor(os.Stderr)
+	rep, err := newReporter(*reportFormat)
+	if err != nil {
+		dieUsage("Bad --report flag: %v", err)
+	}
+	// Stop early on interrupt, reporting how far the run got. Once
+	// interrupted, a second interrupt kills the process as usual.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(sigCtx, func() { stop() })
+
+	if *applyPlan != "" {
+		if len(flag.Args()) != 0 {
+			dieUsage("The --apply-plan flag cannot be used with globs.")
+		}
+		if *resume != "" {
+			dieUsage("The --apply-plan flag cannot be used with --resume.")
+		}
+		p, err := readPlan(*applyPlan)
+		if err != nil {
+			die("Couldn't read plan: %v", err)
+		}
+		ctx, cancel := context.WithCancel(sigCtx)
+		defer cancel()
+		st := handle(ctx, rep, p.results, true, newErrorBudget(*maxErrors, cancel))
+		st.interrupted = sigCtx.Err() != nil
+		st.exit()
+	}
+	if *resume != "" && !*dryRun {
+		var err error
+		if resumeState, err = openResumeLog(*resume); err != nil {
+			die("Couldn't open --resume state file: %v", err)
+		}
+	}
+	if len(flag.Args()) == 0 {
+		usage(os.Stderr)
+		os.Exit(usageExitCode)
+	}
+	if *assertEmpty && !*planHash {
+		dieUsage("The --assert-empty flag requires --plan-hash.")
+	}
+	if *planHash && (*jsonOutput || *reportFormat != "text") {
+		dieUsage("The --plan-hash flag cannot be used with --json or --report.")
+	}
+	if *jsonOutput {
+		if !*dryRun {
+			dieUsage("The --json flag requires --dry_run.")
+		}
+		if *reportFormat != "text" {
+			dieUsage("The --json flag cannot be used with --report.")
+		}
+	}
+	if typeSems, err = typeSemaphores(*typeConc); err != nil {
+		dieUsage("Bad --type-concurrency flag: %v", err)
+	}
+	switch *outputStructure {
+	case "flat":
+	case "mirror":
+		if *destDir == "" {
+			dieUsage("The --output-dir-structure=mirror flag requires --dest-dir.")
+		}
+	default:
+		dieUsage("Bad --output-dir-structure flag: unknown structure %q", *outputStructure)
+	}
+	candidateExts = parseCandidates(*candidates)
+	if *collisionFormat != flag.Lookup("collision-format").DefValue && *dedupeFlag != "number" {
+		dieUsage("The --collision-format flag requires --dedupe=number.")
+	}
+	if *dedupeFlag != "" {
+		if _, ok := dedupeResolvers[*dedupeFlag]; !ok {
+			dieUsage("Bad --dedupe flag: unknown strategy %q", *dedupeFlag)
+		}
+		if !strings.Contains(*collisionFormat, "{n}") {
+			dieUsage("The --collision-format flag must contain {n}.")
+		}
+		if strings.ContainsAny(*collisionFormat, `/\`) {
+			dieUsage("The --collision-format flag must not contain path separators.")
+		}
+		if *dedupeFlag == "subdir" && *destDir == "" {
+			dieUsage("The --dedupe=subdir flag requires --dest-dir.")
+		}
+	}
+
+	globs, err := expandResponseFiles(flag.Args())
+	if err != nil {
+		die("Couldn't expand arguments: %v", err)
+	}
+
+	if *outputStructure == "mirror" {
+		if *sourceRoot == "" {
+			if *sourceRoot, err = commonGlobRoot(globs); err != nil {
+				die("Couldn't determine source root: %v", err)
+			}
+		} else if *sourceRoot, err = filepath.Abs(*sourceRoot); err != nil {
+			die("Couldn't resolve --source-root: %v", err)
+		}
+	}
+
+	// Find files to rename. (find all files before renaming anything to ensure we handle each file only once)
+	files := map[string]struct{}{}
+	badGlobs, resumed := 0, 0
+	for _, pattern := range globs {
+		fns, err := glob(pattern)
+		if err != nil {
+			if !*globErrOK {
+				die("Bad glob %q: %v", pattern, err)
+			}
+			fmt.Fprintf(os.Stderr, "Skipping bad glob %q: %v\n", pattern, err)
+			badGlobs++
+			continue
+		}
+		for _, fn := range fns {
+			if resumeState != nil && resumeState.completed(fn) {
+				resumed++
+				continue
+			}
+			files[fn] = struct{}{}
+		}
+	}
+	if resumed > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming: skipping %d file(s) handled by a previous run\n", resumed)
+	}
+
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+	budget := newErrorBudget(*maxErrors, cancel)
+	p := makePlan(ctx, files, budget)
+	if *planHash {
+		if budget.exceeded() || sigCtx.Err() != nil {
+			st := p.stats()
+			st.aborted, st.interrupted = budget.exceeded(), sigCtx.Err() != nil
+			st.exit()
+		}
+		fmt.Println(p.hash())
+		st := p.stats()
+		st.badGlobs = badGlobs
+		if *assertEmpty && len(p.Renames) > 0 {
+			st.fatal = fmt.Sprintf("Plan is not empty: %d renames planned", len(p.Renames))
+		}
+		st.exit()
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		st := p.stats()
+		st.badGlobs = badGlobs
+		st.aborted, st.interrupted = budget.exceeded(), sigCtx.Err() != nil
+		if !st.aborted && !st.interrupted {
+			if err := enc.Encode(p); err != nil {
+				st.fatal = fmt.Sprintf("Couldn't write plan: %v", err)
+			}
+		}
+		st.exit()
+	}
+	st := handle(ctx, rep, p.results, false, budget)
+	st.badGlobs = badGlobs
+	st.interrupted = sigCtx.Err() != nil
+	st.exit()
+}
+
+// stats holds counts describing the outcome of a run.
+type stats struct {
+	renamed      int  // files which were renamed (or would have been, with --dry_run)
+	skipped      int  // files which were left alone, either because they were already correct or because the run was cancelled
+	errors       int  // files which could not be handled
+	hookFailures int  // --exec hooks which failed
+	chmodFailed  int  // files handled, but whose permissions could not be set per --chmod
+	corrupt      int  // files which failed --check-full-decode
+	badGlobs     int  // glob patterns skipped due to --continue-on-glob-error
+	aborted      bool // whether the run was aborted due to --max-errors
+	interrupted  bool // whether the run was interrupted by a signal
+
+	fatal string // an error which stopped the run, if any
+
+	// Progress, reported if the run is aborted or interrupted.
+	discovered int // files found
+	cancelled  int // files left unhandled because the run was cancelled
+
+	durations []time.Duration // time taken to plan each file, for --format-stats
+
+	// Details, for --summary-json.
+	skipReasons map[string]int // number of skipped files, keyed by skipKey
+	failed      []fileErr      // files which could not be handled, in path order
+}
+
+// exit exits the program, reporting any failures recorded in st and exiting
+// with a non-zero status if there were any.
+func (st stats) exit() {
+	var failures []string
+	if st.errors > 0 {
+		failures = append(failures, fmt.Sprintf("%d errors", st.errors))
+	}
+	if st.hookFailures > 0 {
+		failures = append(failures, fmt.Sprintf("%d hook failures", st.hookFailures))
+	}
+	if st.chmodFailed > 0 {
+		failures = append(failures, fmt.Sprintf("%d chmod failures", st.chmodFailed))
+	}
+	if st.corrupt > 0 {
+		failures = append(failures, fmt.Sprintf("%d corrupt files", st.corrupt))
+	}
+	if st.badGlobs > 0 {
+		failures = append(failures, fmt.Sprintf("%d bad glob patterns", st.badGlobs))
+	}
+	var msg string
+	switch {
+	case st.aborted:
+		msg = fmt.Sprintf("Too many errors: aborted after encountering %s", strings.Join(failures, ", "))
+	case st.interrupted && len(failures) > 0:
+		msg = fmt.Sprintf("Interrupted after encountering %s", strings.Join(failures, ", "))
+	case st.interrupted:
+		msg = "Interrupted"
+	case len(failures) > 0:
+		msg = fmt.Sprintf("Encountered %s", strings.Join(failures, ", "))
+	}
+	if st.fatal != "" {
+		fmt.Fprintln(os.Stderr, st.fatal)
+	}
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	if st.aborted || st.interrupted {
+		fmt.Fprintf(os.Stderr, "Stopped early: %d files found, %d processed (%d renamed), %d remaining\n", st.discovered, st.discovered-st.cancelled, st.renamed, st.cancelled)
+	}
+	failed := msg != "" || st.fatal != ""
+	if *summaryJSON != "" {
+		if err := writeSummary(*summaryJSON, st); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write summary: %v\n", err)
+			failed = true
+		}
+	}
+	if *formatStats != "" {
+		if err := writeMetrics(*formatStats, st); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write metrics: %v\n", err)
+			failed = true
+		}
+	}
+	if *statusLine {
+		w := os.Stdout
+		if *jsonOutput || *reportFormat != "text" {
+			w = os.Stderr
+		}
+		fmt.Fprintf(w, "STATUS renamed=%d skipped=%d errors=%d duration=%s\n", st.renamed, st.skipped, st.errors, time.Since(start).Round(time.Millisecond))
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// errorBudget counts errors, cancelling a context once --max-errors errors
+// have been recorded. It is safe for concurrent use.
+type errorBudget struct {
+	count  int64 // accessed atomically
+	max    int64 // 0 if there is no limit
+	cancel context.CancelFunc
+}
+
+func newErrorBudget(max int, cancel context.CancelFunc) *errorBudget {
+	return &errorBudget{max: int64(max), cancel: cancel}
+}
+
+// record records a single error.
+func (b *errorBudget) record() {
+	if n := atomic.AddInt64(&b.count, 1); b.max > 0 && n == b.max {
+		b.cancel()
+	}
+}
+
+// exceeded determines whether the error limit has been reached.
+func (b *errorBudget) exceeded() bool {
+	return b.max > 0 && atomic.LoadInt64(&b.count) >= b.max
+}
+
+// handle performs the renames among the given results (or just reports them,
+// if --dry_run is set), reporting the final result for each file via rep.
+// Renames which would clobber an existing file are refused. If verify is set,
+// each rename's source is also checked to be unchanged since it was planned.
+//
+// Once ctx is cancelled, no further renames are performed. Errors are recorded
+// in budget. If --transactional is set, every rename is performed before any
+// is reported, so that all may be undone if one fails.
+func handle(ctx context.Context, rep reporter, results []result, verify bool, budget *errorBudget) stats {
+	rep.begin(len(results))
+	hooks := newHookRunner(*concurrency)
+	st := stats{discovered: len(results), skipReasons: map[string]int{}}
+	var corrupt []result
+	results = applyRenames(ctx, results, verify, budget)
+	for _, res := range results {
+		if res.Action == actionRename && renameLogger != nil {
+			if err := renameLogger.record(*res.Rename); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't write to rename log: %v\n", err)
+				st.errors++
+			}
+		}
+		if res.Action == actionEmpty && *removeEmpty && ctx.Err() == nil {
+			res = removeEmptyFile(res)
+		}
+		if res.Action == actionBase64 && *convert && ctx.Err() == nil {
+			res = convertBase64(res)
+		}
+		if resumeState != nil && res.resumeErr == nil {
+			res.resumeErr = recordCompleted(res)
+		}
+		if res.resumeErr != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write to --resume state file: %v\n", res.resumeErr)
+			st.errors++
+		}
+		if *execHook != "" {
+			switch res.Action {
+			case actionRename:
+				hooks.run(res.Path, hookArgs(res.Rename))
+			case actionWouldRename:
+				res.Hook = hookArgs(res.Rename)
+			}
+		}
+		if res.Action == actionCancelled {
+			st.cancelled++
+		}
+		switch res.Action {
+		case actionRename, actionWouldRename, actionConverted, actionWouldConvert:
+			st.renamed++
+		case actionError:
+			st.errors++
+			st.failed = append(st.failed, fileErr{Path: res.Path, Error: res.Err.Error()})
+		default:
+			st.skipped++
+			st.skipReasons[skipKey(res)]++
+		}
+		if res.Mismatch {
+			fmt.Fprintln(os.Stderr, paint(stderrColor, ansiYellow, fmt.Sprintf("Warning: %q has the extension of a different image type, but contains %s data", displayPath(res.Path), res.Type)))
+		}
+		if res.Corrupt != nil {
+			corrupt = append(corrupt, res)
+		}
+		if res.ChmodErr != nil {
+			st.chmodFailed++
+		}
+		rep.report(res)
+	}
+	if len(corrupt) > 0 {
+		fmt.Fprintf(os.Stderr, "%d file(s) have a valid header but failed to fully decode, and may be truncated or corrupt:\n", len(corrupt))
+		for _, res := range corrupt {
+			fmt.Fprintf(os.Stderr, "  %s: %v\n", displayPath(res.Path), res.Corrupt)
+		}
+	}
+	st.corrupt = len(corrupt)
+	st.durations = fileDurations(results)
+	if resumeState != nil {
+		if err := resumeState.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't close --resume state file: %v\n", err)
+			st.errors++
+		}
+	}
+	if renameLogger != nil {
+		if err := renameLogger.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't close rename log: %v\n", err)
+			st.errors++
+		}
+	}
+	st.hookFailures = hooks.wait()
+	st.aborted = budget.exceeded()
+	if err := rep.finish(); err != nil {
+		st.fatal = fmt.Sprintf("Couldn't write report: %v", err)
+	}
+	return st
+}
+
+// applyRenames performs the renames among results via imgext.Apply (or just
+// checks them, if --dry_run is set), returning the updated results. Once ctx
+// is cancelled, no further renames are performed. If --transactional is set,
+// either all of the renames are performed, or none of them: once any rename
+// fails (or is cancelled), no further renames are attempted and those already
+// performed are undone, in reverse order. Renames which cannot be undone are
+// reported as errors, so that the user can fix them up by hand.
+func applyRenames(ctx context.Context, results []result, verify bool, budget *errorBudget) []result {
+	results = append([]result(nil), results...)
+	var (
+		plan    []imgext.Rename
+		indices []int // the index in results of each rename in plan
+		fsys    = placeFS{}
+	)
+	for i, res := range results {
+		if res.Action != actionRename {
+			continue
+		}
+		plan = append(plan, imgext.Rename{From: res.Rename.From, To: res.Rename.To})
+		indices = append(indices, i)
+		if verify {
+			fsys[res.Rename.From] = *res.Rename
+		}
+	}
+	if len(plan) == 0 {
+		return results
+	}
+	out, _ := imgext.Apply(plan, imgext.ExecuteOptions{
+		Context:    ctx,
+		DryRun:     *dryRun,
+		FileSystem: fsys,
+		OnError: func(imgext.Rename, error) bool {
+			budget.record()
+			return !*transactional
+		},
+	})
+
+	var done []int // indices of performed renames, in the order performed
+	failed := false
+	for j, o := range out.Outcomes {
+		res := &results[indices[j]]
+		switch {
+		case o.Err != nil:
+			res.Action, res.Err = actionError, o.Err
+			failed = true
+		case !o.Renamed:
+			res.Action = actionCancelled
+			failed = true
+		case *dryRun:
+			res.Action = actionWouldRename
+		default:
+			done = append(done, indices[j])
+		}
+	}
+	if *transactional && failed {
+		for j := len(done) - 1; j >= 0; j-- {
+			res := &results[done[j]]
+			if err := unplaceFile(res.Rename.From, res.Rename.To); err != nil {
+				res.Action, res.Err = actionError, fmt.Errorf("couldn't roll back rename to %q: %w", res.Rename.To, wrapVanished(err))
+				budget.record()
+				continue
+			}
+			res.Action = actionRolledBack
+		}
+		return results
+	}
+	if chmodFn != nil {
+		for _, i := range done {
+			// The rename has happened regardless, so is not failed.
+			results[i].ChmodErr = applyChmod(results[i].Rename.To)
+		}
+	}
+	return results
+}
+
+// removeEmptyFile removes the empty file described by res, per --remove-empty
+// (or just reports it, if --dry_run is set), returning the updated result.
+func removeEmptyFile(res result) result {
+	if *dryRun {
+		res.Action = actionWouldRemove
+		return res
+	}
+	// Re-check the file's size, in case it has been written to since it was
+	// planned.
+	if fi, err := os.Lstat(res.Path); err != nil {
+		res.Action, res.Err = actionError, fmt.Errorf("couldn't stat: %w", wrapVanished(err))
+	} else if fi.Size() != 0 {
+		res.Action, res.Err = actionError, fmt.Errorf("file is no longer empty")
+	} else if err := os.Remove(res.Path); err != nil {
+		res.Action, res.Err = actionError, fmt.Errorf("couldn't remove: %w", err)
+	} else {
+		res.Action = actionRemoved
+	}
+	return res
+}
+
+// wrapVanished wraps err with imgext.ErrVanished if it reports that a file
+// does not exist.
+func wrapVanished(err error) error {
+	if errors.Is(err, fs.ErrNotExist) && !errors.Is(err, imgext.ErrVanished) {
+		return fmt.Errorf("%w: %w", imgext.ErrVanished, err)
+	}
+	return err
+}
+
+// parseTypeConcurrency parses the value of the --type-concurrency flag into a
+// map from type, per typeKey, to concurrency limit.
+func parseTypeConcurrency(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	listed := map[string]string{} // the extension listed for each type
+	for _, entry := range strings.Split(s, ",") {
+		ext, nStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not of the form ext:N", entry)
+		}
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		n, err := strconv.Atoi(strings.TrimSpace(nStr))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("entry %q has a bad limit (must be a positive integer)", entry)
+		}
+		key := ext
+		if key != "default" {
+			key = typeKey(ext)
+		}
+		switch prev, ok := listed[key]; {
+		case ok && prev == ext:
+			return nil, fmt.Errorf("extension %q listed more than once", ext)
+		case ok:
+			return nil, fmt.Errorf("extensions %q and %q are of the same type", prev, ext)
+		}
+		listed[key] = ext
+		limits[key] = n
+	}
+	return limits, nil
+}
+
+// typeSemaphores returns the semaphores enforcing the given --type-concurrency
+// limits, keyed as for typeSems.
+func typeSemaphores(s string) (map[string]chan struct{}, error) {
+	sems := map[string]chan struct{}{}
+	if s == "" {
+		return sems, nil
+	}
+	limits, err := parseTypeConcurrency(s)
+	if err != nil {
+		return nil, err
+	}
+	for key, n := range limits {
+		sems[key] = make(chan struct{}, n)
+	}
+	return sems, nil
+}
+
+// typeKey returns the key of the --type-concurrency limit applying to files
+// with the given (lower-cased, dotless) extension: the type which uses it, per
+// typeExts, so that e.g. "tif" & "tiff" share a limit, or the extension itself
+// if it is not an image extension.
+func typeKey(ext string) string {
+	for typ, exts := range typeExts {
+		for _, e := range exts {
+			if e == ext {
+				return typ
+			}
+		}
+	}
+	return ext
+}
+
+// parseCandidates parses the value of the --candidates flag into a set of
+// lower-cased extensions, without leading dots. It returns nil if s is empty.
+func parseCandidates(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	exts := map[string]bool{}
+	for _, ext := range strings.Split(s, ",") {
+		exts[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))] = true
+	}
+	return exts
+}
+
+// expandResponseFiles replaces each argument of the form "@file" with the
+// contents of the named file, one argument per non-empty line. Response files
+// may themselves contain @file arguments.
+func expandResponseFiles(args []string) ([]string, error) {
+	var expand func(args []string, stack []string) ([]string, error)
+	expand = func(args []string, stack []string) ([]string, error) {
+		var rslt []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "@") {
+				rslt = append(rslt, arg)
+				continue
+			}
+			fn := arg[1:]
+			absFN, err := filepath.Abs(fn)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't resolve %q: %w", fn, err)
+			}
+			for i, s := range stack {
+				if s == absFN {
+					return nil, fmt.Errorf("response file cycle: %s", strings.Join(append(stack[i:], absFN), " -> "))
+				}
+			}
+			if len(stack) >= maxResponseFileDepth {
+				return nil, fmt.Errorf("response files nested more than %d deep at %q", maxResponseFileDepth, fn)
+			}
+			buf, err := os.ReadFile(fn)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read response file: %w", err)
+			}
+			var fileArgs []string
+			for _, line := range strings.Split(string(buf), "\n") {
+				if line = strings.TrimSuffix(line, "\r"); line != "" {
+					fileArgs = append(fileArgs, line)
+				}
+			}
+			expanded, err := expand(fileArgs, append(stack, absFN))
+			if err != nil {
+				return nil, err
+			}
+			rslt = append(rslt, expanded...)
+		}
+		return rslt, nil
+	}
+	return expand(args, nil)
+}
+
+// usage writes usage information, including all flags & their defaults, to w.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage:\n  imgext [flags] globs\n  imgext [flags] @file  (file contains globs, one per line)\n  imgext [flags] --apply-plan=plan.json\n\nFlags:\n")
+	flag.CommandLine.SetOutput(w)
+	defer flag.CommandLine.SetOutput(nil)
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\nEach flag may also be set by an environment variable named after it,\ne.g. %s=true for --dry_run. Flags given on the command line take precedence.\n", envName("dry_run"))
+}
+
+// die exits the program, reporting the given error as a failure which stopped
+// the run before any file was handled. Like any other run's end, it writes the
+// --status-line, --summary-json & --format-stats output.
+func die(format string, args ...interface{}) {
+	stats{fatal: fmt.Sprintf(format, args...)}.exit()
+}
+
+// dieUsage is like die, but exits with usageExitCode.
+func dieUsage(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(usageExitCode)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/imgext"
+)
+
+var update = flag.Bool("update", false, "If set, update golden files rather than comparing against them.")
+
+// runMainEnv is the environment variable which, if set, makes the test binary
+// run main rather than the tests; see runMain.
+const runMainEnv = "RUN_IMGEXT_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the imgext command (as the test binary) in dir with the given
+// arguments & additional environment variables, returning its combined output
+// & exit code. IMGEXT_ environment variables are not inherited.
+func runMain(t *testing.T, dir string, env []string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = []string{runMainEnv + "=1"}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("Couldn't run imgext: %v", err)
+	}
+	return string(out), cmd.ProcessState.ExitCode()
+}
+
+// Fixture content, of known type.
+var (
+	jpegData = encodeImage(func(b *bytes.Buffer, m image.Image) error { return jpeg.Encode(b, m, nil) })
+	pngData  = encodeImage(func(b *bytes.Buffer, m image.Image) error { return png.Encode(b, m) })
+	gifData  = encodeImage(func(b *bytes.Buffer, m image.Image) error { return gif.Encode(b, m, nil) })
+	jxlData  = append([]byte("\x00\x00\x00\x0cJXL \r\n\x87\n"), make([]byte, 32)...) // a container's signature box, and padding
+	textData = []byte("hello, world\n")
+)
+
+// encodeImage returns a small image, as encoded by enc.
+func encodeImage(enc func(*bytes.Buffer, image.Image) error) []byte {
+	var b bytes.Buffer
+	if err := enc(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// writeFiles creates the given files, keyed by name relative to dir.
+func writeFiles(t testing.TB, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listFiles returns the names of the regular files under dir, relative to
+// dir, in sorted order.
+func listFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(dir, func(fn string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, fn)
+		names = append(names, filepath.ToSlash(name))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setFlags sets the given flags, as name/value pairs, for the duration of the
+// test, and updates the state derived from them.
+func setFlags(t *testing.T, kv ...string) {
+	t.Helper()
+	for i := 0; i < len(kv); i += 2 {
+		name := kv[i]
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, kv[i+1]); err != nil {
+			t.Fatalf("Couldn't set --%s: %v", name, err)
+		}
+		t.Cleanup(func() { flag.Set(name, old) })
+	}
+	classifier = imgext.Classifier{RAW: *raw, SignatureOnly: *noFullDecode, NonImages: *nonImages, APNGExt: *apngExt}
+	candidateExts = parseCandidates(*candidates)
+	sems, err := typeSemaphores(*typeConc)
+	if err != nil {
+		t.Fatalf("Bad --type-concurrency: %v", err)
+	}
+	typeSems = sems
+	t.Cleanup(func() {
+		classifier, candidateExts, typeSems = imgext.Classifier{}, nil, map[string]chan struct{}{}
+	})
+}
+
+// recorder is a reporter which records the results reported to it.
+type recorder struct{ results []result }
+
+func (r *recorder) begin(int)         {}
+func (r *recorder) report(res result) { r.results = append(r.results, res) }
+func (r *recorder) finish() error     { return nil }
+
+// run runs the pipeline over every file under dir, as the imgext command does
+// for the glob dir/**, returning the stats & results of the run.
+func run(t *testing.T, dir string) (stats, []result) {
+	t.Helper()
+	if *concurrency == 0 {
+		setFlags(t, "concurrency", "2")
+	}
+	files := map[string]struct{}{}
+	for _, name := range listFiles(t, dir) {
+		files[filepath.Join(dir, filepath.FromSlash(name))] = struct{}{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	budget := newErrorBudget(*maxErrors, cancel)
+	p := makePlan(ctx, files, budget)
+	var rec recorder
+	st := handle(ctx, &rec, p.results, false, budget)
+	return st, rec.results
+}
+
+func TestRun(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		files   map[string][]byte
+		flags   []string
+		want    []string // files afterward
+		renamed int
+		errors  int
+	}{
+		{
+			name:    "jpeg is renamed to jpg",
+			files:   map[string][]byte{"photo.jpeg": jpegData},
+			want:    []string{"photo.jpg"},
+			renamed: 1,
+		},
+		{
+			name:    "png",
+			files:   map[string][]byte{"pic.bin": pngData},
+			want:    []string{"pic.png"},
+			renamed: 1,
+		},
+		{
+			name:    "gif",
+			files:   map[string][]byte{"anim.dat": gifData},
+			want:    []string{"anim.gif"},
+			renamed: 1,
+		},
+		{
+			name:    "missing extension",
+			files:   map[string][]byte{"noext": pngData},
+			want:    []string{"noext.png"},
+			renamed: 1,
+		},
+		{
+			name:  "already correct",
+			files: map[string][]byte{"ok.png": pngData, "ok.jpg": jpegData, "ok.gif": gifData},
+			want:  []string{"ok.gif", "ok.jpg", "ok.png"},
+		},
+		{
+			name:   "non-image",
+			files:  map[string][]byte{"notes.txt": textData},
+			want:   []string{"notes.txt"},
+			errors: 1,
+		},
+		{
+			name:   "collision with existing file",
+			files:  map[string][]byte{"pic.bin": pngData, "pic.png": pngData},
+			want:   []string{"pic.bin", "pic.png"},
+			errors: 1,
+		},
+		{
+			name:    "collision with another rename",
+			files:   map[string][]byte{"pic.bin": pngData, "pic.dat": pngData},
+			want:    []string{"pic.dat", "pic.png"},
+			renamed: 1,
+			errors:  1,
+		},
+		{
+			// Decomposed names are composed, even if only the normalization
+			// form differs; composed names are left alone.
+			name:    "normalize to nfc",
+			files:   map[string][]byte{"cafe\u0301.bin": pngData, "cafe\u0301 2.png": pngData, "caf\u00e9 3.png": pngData},
+			flags:   []string{"normalize-unicode", "nfc"},
+			want:    []string{"caf\u00e9 2.png", "caf\u00e9 3.png", "caf\u00e9.png"},
+			renamed: 2,
+		},
+		{
+			name:    "normalize to nfd",
+			files:   map[string][]byte{"caf\u00e9.bin": pngData, "caf\u00e9 2.png": pngData, "cafe\u0301 3.png": pngData},
+			flags:   []string{"normalize-unicode", "nfd"},
+			want:    []string{"cafe\u0301 2.png", "cafe\u0301 3.png", "cafe\u0301.png"},
+			renamed: 2,
+		},
+		{
+			name:    "dry run",
+			files:   map[string][]byte{"photo.jpeg": jpegData, "pic.bin": pngData, "notes.txt": textData},
+			flags:   []string{"dry_run", "true"},
+			want:    []string{"notes.txt", "photo.jpeg", "pic.bin"},
+			renamed: 2,
+			errors:  1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.flags...)
+			dir := t.TempDir()
+			writeFiles(t, dir, test.files)
+			st, _ := run(t, dir)
+			if got := listFiles(t, dir); !slices.Equal(got, test.want) {
+				t.Errorf("Files afterward = %q, want %q", got, test.want)
+			}
+			if st.renamed != test.renamed || st.errors != test.errors {
+				t.Errorf("Got %d renamed & %d errors, want %d & %d", st.renamed, st.errors, test.renamed, test.errors)
+			}
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	files := map[string][]byte{
+		"photo.jpeg":    jpegData,
+		"pic.bin":       pngData,
+		"ok.png":        pngData,
+		"notes.txt":     textData,
+		"empty.dat":     nil,
+		"clash.bin":     gifData,
+		"clash.dat":     gifData,
+		"sub/anim.dat":  gifData,
+		"sub/b, c.JPEG": jpegData,
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "golden.txt"))
+	if err != nil && !*update {
+		t.Fatal(err)
+	}
+	for _, conc := range []string{"1", "8"} {
+		t.Run("concurrency="+conc, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, files)
+			got, code := runMain(t, dir, nil, "--concurrency="+conc, "--verbose", "*.*", "sub/*")
+			if code != 1 {
+				t.Errorf("Exit code = %d, want 1", code)
+			}
+			if *update && conc == "1" {
+				if err := os.WriteFile(filepath.Join("testdata", "golden.txt"), []byte(got), 0666); err != nil {
+					t.Fatal(err)
+				}
+				want = []byte(got)
+			}
+			if got != string(want) {
+				t.Errorf("Got output:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"notes.txt": textData,
+		"pic.bin":   pngData,
+		"pic.png":   gifData,
+		"gone.bin":  pngData,
+	})
+	setFlags(t, "concurrency", "1")
+	files := map[string]struct{}{}
+	for _, name := range listFiles(t, dir) {
+		files[filepath.Join(dir, name)] = struct{}{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	budget := newErrorBudget(0, cancel)
+	p := makePlan(ctx, files, budget)
+	if err := os.Remove(filepath.Join(dir, "gone.bin")); err != nil {
+		t.Fatal(err)
+	}
+	var rec recorder
+	handle(ctx, &rec, p.results, false, budget)
+
+	want := map[string]error{
+		"notes.txt": imgext.ErrUnsupportedFormat,
+		"pic.bin":   imgext.ErrDestinationExists,
+		"gone.bin":  imgext.ErrVanished,
+	}
+	for _, res := range rec.results {
+		name := filepath.Base(res.Path)
+		if wantErr, ok := want[name]; ok && !errors.Is(res.Err, wantErr) {
+			t.Errorf("%s: got error %v, want one wrapping %v", name, res.Err, wantErr)
+		}
+	}
+}
+
+// TestCaseOnlyRenames tests renames which only change the case of a file's
+// extension, for each supported type. On case-insensitive filesystems (as
+// t.TempDir is on e.g. macOS & Windows by default), these are performed via a
+// temporary name.
+func TestCaseOnlyRenames(t *testing.T) {
+	raw := func(sig string) []byte { return append([]byte(sig), make([]byte, 64)...) }
+	for _, test := range []struct {
+		from, to string
+		data     []byte
+	}{
+		{"photo.JPG", "photo.jpg", jpegData},
+		{"photo.Jpg", "photo.jpg", jpegData},
+		{"photo.JPEG", "photo.jpg", jpegData},
+		{"pic.PNG", "pic.png", pngData},
+		{"pic.pNg", "pic.png", pngData},
+		{"anim.GIF", "anim.gif", gifData},
+		{"image.JXL", "image.jxl", jxlData},
+		{"raw.CR3", "raw.cr3", raw("\x00\x00\x00\x18ftypcrx ")},
+		{"raw.ORF", "raw.orf", raw("IIRO")},
+		{"raw.RW2", "raw.rw2", raw("IIU\x00")},
+		{"raw.RAF", "raw.raf", raw("FUJIFILMCCD-RAW ")},
+	} {
+		t.Run(test.from, func(t *testing.T) {
+			setFlags(t, "raw", "true")
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{test.from: test.data})
+			st, _ := run(t, dir)
+			if got, want := listFiles(t, dir), []string{test.to}; !slices.Equal(got, want) {
+				t.Errorf("Files afterward = %q, want %q", got, want)
+			}
+			if st.renamed != 1 || st.errors != 0 {
+				t.Errorf("Got %d renamed & %d errors, want 1 & 0", st.renamed, st.errors)
+			}
+		})
+	}
+}
+
+func TestTransactional(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		setFlags(t, "transactional", "true")
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "b.bin": jpegData, "c.bin": gifData})
+		st, _ := run(t, dir)
+		if got, want := listFiles(t, dir), []string{"a.png", "b.jpg", "c.gif"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+		if st.renamed != 3 || st.errors != 0 {
+			t.Errorf("Got %d renamed & %d errors, want 3 & 0", st.renamed, st.errors)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		setFlags(t, "transactional", "true", "concurrency", "1")
+		dir := t.TempDir()
+		otherPNG := append(append([]byte(nil), pngData...), "trailing"...)
+		files := map[string][]byte{"a.bin": pngData, "b.bin": pngData, "b.png": otherPNG, "c.bin": gifData}
+		writeFiles(t, dir, files)
+		st, results := run(t, dir)
+		if got, want := listFiles(t, dir), []string{"a.bin", "b.bin", "b.png", "c.bin"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+		for name, data := range files {
+			// In particular, b.png must not have been overwritten.
+			if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s has changed (err = %v)", name, err)
+			}
+		}
+		want := map[string]action{"a.bin": actionRolledBack, "b.bin": actionError, "b.png": actionUnchanged, "c.bin": actionCancelled}
+		for _, res := range results {
+			if name := filepath.Base(res.Path); res.Action != want[name] {
+				t.Errorf("%s: got action %v, want %v", name, res.Action, want[name])
+			}
+		}
+		if st.renamed != 0 || st.errors != 1 {
+			t.Errorf("Got %d renamed & %d errors, want 0 & 1", st.renamed, st.errors)
+		}
+	})
+}
+
+func TestCancelMidRun(t *testing.T) {
+	files := map[string][]byte{"a.txt": textData, "b.bin": pngData, "c.bin": pngData, "d.bin": pngData}
+
+	t.Run("while planning", func(t *testing.T) {
+		// The first file is an error, which aborts the run per --max-errors.
+		dir := t.TempDir()
+		writeFiles(t, dir, files)
+		out, code := runMain(t, dir, nil, "--concurrency=1", "--max-errors=1", "*")
+		if code != 1 {
+			t.Errorf("Exit code = %d, want 1", code)
+		}
+		for _, want := range []string{
+			"Too many errors: aborted after encountering 1 errors\n",
+			"Stopped early: 4 files found, 1 processed (0 renamed), 3 remaining\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("Output does not contain %q:\n%s", want, out)
+			}
+		}
+		if got, want := listFiles(t, dir), []string{"a.txt", "b.bin", "c.bin", "d.bin"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("while renaming", func(t *testing.T) {
+		// The first rename fails, as its destination is taken, which aborts
+		// the run per --max-errors.
+		setFlags(t, "concurrency", "1")
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "a.png": pngData, "b.bin": pngData, "c.bin": pngData})
+		fns := map[string]struct{}{}
+		for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+			fns[filepath.Join(dir, name)] = struct{}{}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := makePlan(ctx, fns, newErrorBudget(0, cancel))
+		budget := newErrorBudget(1, cancel)
+		st := handle(ctx, &recorder{}, p.results, false, budget)
+		if !st.aborted || st.discovered != 3 || st.renamed != 0 || st.errors != 1 || st.cancelled != 2 {
+			t.Errorf("Got aborted = %t, %d discovered, %d renamed, %d errors & %d cancelled; want true, 3, 0, 1 & 2", st.aborted, st.discovered, st.renamed, st.errors, st.cancelled)
+		}
+		if got, want := listFiles(t, dir), []string{"a.bin", "a.png", "b.bin", "c.bin"}; !slices.Equal(got, want) {
+			t.Errorf("Files afterward = %q, want %q", got, want)
+		}
+	})
+}
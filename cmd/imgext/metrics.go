@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricQuantiles are the quantiles of per-file durations reported by
+// writeMetrics.
+var metricQuantiles = []float64{0.5, 0.9, 0.99}
+
+// fileDurations returns the time taken to plan each of the given results,
+// omitting those which were never planned (e.g. due to cancellation, or because
+// they came from --apply-plan).
+func fileDurations(results []result) []time.Duration {
+	var ds []time.Duration
+	for _, res := range results {
+		if res.Duration > 0 {
+			ds = append(ds, res.Duration)
+		}
+	}
+	return ds
+}
+
+// writeMetrics writes metrics describing st to the named file in the
+// Prometheus text exposition format, per --format-stats. The file is replaced
+// atomically, as required by node_exporter's textfile collector.
+func writeMetrics(fn string, st stats) error {
+	var b strings.Builder
+	metric := func(name, typ, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, value)
+	}
+	metric("imgext_renamed_total", "counter", "Files renamed (or which would have been, with --dry_run).", float64(st.renamed))
+	metric("imgext_skipped_total", "counter", "Files left unchanged.", float64(st.skipped))
+	metric("imgext_errors_total", "counter", "Files which could not be handled.", float64(st.errors))
+	metric("imgext_hook_failures_total", "counter", "--exec hooks which failed.", float64(st.hookFailures))
+	metric("imgext_chmod_failures_total", "counter", "Files whose permissions could not be set per --chmod.", float64(st.chmodFailed))
+	metric("imgext_run_duration_seconds", "gauge", "Wall-clock duration of the run.", time.Since(start).Seconds())
+	metric("imgext_last_run_timestamp_seconds", "gauge", "Unix time at which the run started.", float64(start.UnixNano())/1e9)
+
+	ds := append([]time.Duration(nil), st.durations...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	const name = "imgext_file_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time taken to classify each file.\n# TYPE %s summary\n", name, name)
+	for _, q := range metricQuantiles {
+		v := "NaN"
+		if len(ds) > 0 {
+			// Use the nearest-rank method.
+			v = fmt.Sprintf("%g", ds[int(q*float64(len(ds)-1)+0.5)].Seconds())
+		}
+		fmt.Fprintf(&b, "%s{quantile=\"%g\"} %s\n", name, q, v)
+	}
+	fmt.Fprintf(&b, "%s_sum %g\n%s_count %d\n", name, sum.Seconds(), name, len(ds))
+
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
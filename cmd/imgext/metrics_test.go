@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Patterns of the lines of the Prometheus text exposition format.
+var (
+	metricComment = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	metricSample  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+// parseMetrics parses a document in the Prometheus text exposition format,
+// failing the test if it is malformed. It returns the value of each sample,
+// keyed by name & labels.
+func parseMetrics(t *testing.T, doc string) map[string]float64 {
+	t.Helper()
+	if !strings.HasSuffix(doc, "\n") {
+		t.Errorf("Document does not end in a newline")
+	}
+	types := map[string]string{} // keyed by metric family
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSuffix(doc, "\n"), "\n") {
+		if m := metricComment.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				if _, ok := types[m[2]]; ok {
+					t.Errorf("Metric %s has more than one TYPE", m[2])
+				}
+				switch m[3] {
+				case "counter", "gauge", "summary", "histogram", "untyped":
+				default:
+					t.Errorf("Metric %s has bad type %q", m[2], m[3])
+				}
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := metricSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("Malformed line %q", line)
+			continue
+		}
+		family := m[1]
+		if typ, ok := types[strings.TrimSuffix(strings.TrimSuffix(family, "_sum"), "_count")]; ok && typ == "summary" {
+			family = strings.TrimSuffix(strings.TrimSuffix(family, "_sum"), "_count")
+		}
+		if _, ok := types[family]; !ok {
+			t.Errorf("Sample %q precedes its metric's TYPE", line)
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("Sample %q has bad value: %v", line, err)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	return samples
+}
+
+func TestWriteMetrics(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "imgext.prom")
+	st := stats{
+		renamed:      2,
+		skipped:      1,
+		errors:       3,
+		hookFailures: 4,
+		chmodFailed:  5,
+		durations:    []time.Duration{3 * time.Second, time.Second, 2 * time.Second},
+	}
+	if err := writeMetrics(fn, st); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseMetrics(t, string(data))
+	for name, want := range map[string]float64{
+		"imgext_renamed_total":                          2,
+		"imgext_skipped_total":                          1,
+		"imgext_errors_total":                           3,
+		"imgext_hook_failures_total":                    4,
+		"imgext_chmod_failures_total":                   5,
+		`imgext_file_duration_seconds{quantile="0.5"}`:  2,
+		`imgext_file_duration_seconds{quantile="0.99"}`: 3,
+		"imgext_file_duration_seconds_sum":              6,
+		"imgext_file_duration_seconds_count":            3,
+	} {
+		if v, ok := got[name]; !ok || v != want {
+			t.Errorf("%s = %v (present: %t), want %v", name, v, ok, want)
+		}
+	}
+	for _, name := range []string{"imgext_run_duration_seconds", "imgext_last_run_timestamp_seconds"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+}
+
+func TestWriteMetricsNoFiles(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "imgext.prom")
+	if err := writeMetrics(fn, stats{}); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseMetrics(t, string(data)); got["imgext_file_duration_seconds_count"] != 0 {
+		t.Errorf("imgext_file_duration_seconds_count = %v, want 0", got["imgext_file_duration_seconds_count"])
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/BranLwyd/imgext"
+	"golang.org/x/text/unicode/norm"
+)
+
+// unicodeForms holds the available --normalize-unicode forms, keyed by name.
+var unicodeForms = map[string]norm.Form{
+	"nfc": norm.NFC,
+	"nfd": norm.NFD,
+}
+
+// normalizeStem returns fn with the stem of its final path element (that is,
+// the name without its extension) converted to the --normalize-unicode form,
+// if that is set. The directory & extension are left untouched.
+func normalizeStem(fn string) string {
+	form, ok := unicodeForms[*unicodeForm]
+	if !ok {
+		return fn
+	}
+	dir, base := filepath.Split(fn)
+	stem := base[:len(base)-len(imgext.Ext(base))]
+	return dir + form.String(stem) + base[len(stem):]
+}
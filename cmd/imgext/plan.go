@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/imgext"
+)
+
+// planVersion is the version of the plan document schema. It must be bumped
+// whenever the schema changes in an incompatible way.
+const planVersion = 1
+
+// plan is a set of renames computed from a set of files. It is also the
+// schema of the JSON document produced by --dry_run --json, and consumed by
+// --apply-plan.
+type plan struct {
+	Version   int        `json:"version"`   // always planVersion
+	Renames   []rename   `json:"renames"`   // renames to perform, sorted by source path
+	Conflicts []conflict `json:"conflicts"` // destinations which would clobber an existing file, sorted by destination path
+	Errors    []fileErr  `json:"errors"`    // files which could not be handled, sorted by path
+	Summary   summary    `json:"summary"`
+
+	results []result // the result of planning each file, sorted by path
+}
+
+// rename is a single planned rename. The size & modification time of the
+// source file are recorded so that the source can be re-verified before the
+// rename is performed.
+type rename struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Type    string    `json:"type"` // the detected image type, e.g. "png"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// conflict describes a destination path which is the target of more than one
+// rename, or which already exists on disk.
+type conflict struct {
+	To     string   `json:"to"`
+	From   []string `json:"from"`   // sources renamed to To, sorted
+	Exists bool     `json:"exists"` // whether To already exists
+}
+
+// fileErr describes a file which could not be handled.
+type fileErr struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// summary holds counts describing a plan.
+type summary struct {
+	Files     int `json:"files"`     // number of files considered
+	Renames   int `json:"renames"`   // number of files which would be renamed
+	Unchanged int `json:"unchanged"` // number of files which already have the correct extension
+	Empty     int `json:"empty"`     // number of empty (zero-byte) files
+	Conflicts int `json:"conflicts"` // number of conflicting destinations
+	Errors    int `json:"errors"`    // number of files which could not be handled
+}
+
+// feedBuffer is the capacity of the channel handing files to makePlan's
+// workers, as a multiple of --concurrency. It is buffered so that workers
+// rarely wait on the feeder for small files; see BenchmarkMakePlan.
+var feedBuffer = 1
+
+// makePlan classifies the given files, returning a plan describing the renames
+// required to give each file the correct extension. Errors are recorded in
+// budget. Once ctx is cancelled, no further files are classified; their
+// results are left as actionCancelled.
+func makePlan(ctx context.Context, files map[string]struct{}, budget *errorBudget) *plan {
+	fns := make([]string, 0, len(files))
+	for fn := range files {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+
+	// Classify files; each worker writes to its own index of results.
+	var wg sync.WaitGroup
+	results := make([]result, len(fns))
+	for i, fn := range fns {
+		results[i] = result{Path: fn, Action: actionCancelled}
+	}
+	ch := make(chan int, feedBuffer**concurrency)
+	var batch sync.WaitGroup // files of the current batch which are not yet done
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				if ctx.Err() == nil {
+					t := time.Now()
+					results[i] = planFile(fns[i])
+					results[i].Duration = time.Since(t)
+					if results[i].Action == actionError {
+						budget.record()
+					}
+					if resumeState != nil {
+						// Record files found to be correct right away, rather
+						// than once every file is planned, so that little work
+						// is lost if the run crashes.
+						results[i].resumeErr = recordPlanned(results[i])
+					}
+				} // otherwise, drain the channel
+				releaseTypeSem(fns[i])
+				batch.Done()
+			}
+		}()
+	}
+	feed(ctx, fns, ch, &batch)
+	close(ch)
+	wg.Wait()
+	if *dedupeFlag != "" && ctx.Err() == nil {
+		dedupe(results, dedupeResolvers[*dedupeFlag])
+	}
+
+	// Assemble the plan.
+	p := &plan{
+		Version:   planVersion,
+		Renames:   []rename{},
+		Conflicts: []conflict{},
+		Errors:    []fileErr{},
+		results:   results,
+	}
+	unchanged, empty := 0, 0
+	for _, res := range results {
+		switch res.Action {
+		case actionError:
+			p.Errors = append(p.Errors, fileErr{Path: res.Path, Error: res.Err.Error()})
+		case actionRename:
+			p.Renames = append(p.Renames, *res.Rename)
+		case actionUnchanged:
+			unchanged++
+		case actionEmpty:
+			empty++
+		}
+	}
+	p.Conflicts = findConflicts(p.Renames)
+	p.Summary = summary{
+		Files:     len(fns),
+		Renames:   len(p.Renames),
+		Unchanged: unchanged,
+		Empty:     empty,
+		Conflicts: len(p.Conflicts),
+		Errors:    len(p.Errors),
+	}
+	return p
+}
+
+// base64Result returns the result for the named file, which holds a
+// base64-encoded image of type typ, per --decode-base64. Its Rename describes
+// where the decoded image would be written by --convert.
+func base64Result(fn, typ string) result {
+	newFN := newName(fn, typ)
+	if *destDir != "" {
+		var err error
+		if newFN, err = destPath(fn, newFN); err != nil {
+			return result{Path: fn, Action: actionError, Err: err}
+		}
+	}
+	return result{Path: fn, Type: typ, Rename: &rename{From: fn, To: newFN, Type: typ}, Action: actionBase64}
+}
+
+// feed sends the indices of the given (sorted) files to ch, batch by batch per
+// feedBatches, waiting on batch for each batch to be finished before starting
+// the next. Each file's --type-concurrency semaphore, if any, is acquired
+// before the file is sent, and must be released by releaseTypeSem once the
+// file is finished. Files whose semaphore is full are held back, rather than
+// sent to a worker which would wait on it, so that files of other types flow
+// past them. Once ctx is cancelled, no further files are sent.
+func feed(ctx context.Context, fns []string, ch chan<- int, batch *sync.WaitGroup) {
+	for _, b := range feedBatches(fns) {
+		batch.Add(len(b))
+		var held []int // files held back, in order
+		for len(b) > 0 || len(held) > 0 {
+			// Send held-back files first, as soon as they may be started.
+			i := -1
+			for j, h := range held {
+				if acquireTypeSem(fns[h]) {
+					i = h
+					held = append(held[:j], held[j+1:]...)
+					break
+				}
+			}
+			if i < 0 && len(b) > 0 {
+				if acquireTypeSem(fns[b[0]]) {
+					i = b[0]
+				} else {
+					held = append(held, b[0])
+				}
+				b = b[1:]
+			}
+			if i < 0 {
+				if len(b) > 0 {
+					continue
+				}
+				// Only held-back files remain: wait for a semaphore to be released.
+				select {
+				case <-typeFreed:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				releaseTypeSem(fns[i])
+				return
+			}
+		}
+		batch.Wait()
+	}
+}
+
+// typeSem returns the --type-concurrency semaphore for the named file, or nil
+// if it is not limited. The file's current extension is used as a proxy for
+// its type.
+func typeSem(fn string) chan struct{} {
+	if len(typeSems) == 0 {
+		return nil
+	}
+	sem, ok := typeSems[typeKey(strings.ToLower(strings.TrimPrefix(imgext.Ext(fn), ".")))]
+	if !ok {
+		sem = typeSems["default"]
+	}
+	return sem
+}
+
+// acquireTypeSem acquires the --type-concurrency semaphore for the named file,
+// if any, without waiting. It returns false if the semaphore is full.
+func acquireTypeSem(fn string) bool {
+	sem := typeSem(fn)
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseTypeSem releases the --type-concurrency semaphore for the named file,
+// as acquired by acquireTypeSem.
+func releaseTypeSem(fn string) {
+	if sem := typeSem(fn); sem != nil {
+		<-sem
+		select {
+		case typeFreed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// feedBatches returns the indices of the given (sorted) files in the order in
+// which they are to be classified, split into batches; each batch is finished
+// before the next is started. Normally there is a single batch, in path order.
+// With --batch-by-dir, there is one batch per directory, so that files in
+// different directories are not worked on at once.
+func feedBatches(fns []string) [][]int {
+	if !*batchByDir {
+		all := make([]int, len(fns))
+		for i := range all {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+	byDir := map[string][]int{}
+	var dirs []string
+	for i, fn := range fns {
+		dir := filepath.Dir(fn)
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], i)
+	}
+	sort.Strings(dirs)
+	batches := make([][]int, len(dirs))
+	for i, dir := range dirs {
+		batches[i] = byDir[dir]
+	}
+	return batches
+}
+
+// planFile classifies a single file, returning a result describing the rename
+// required to give it the correct extension, if any.
+func planFile(fn string) result {
+	ext := strings.ToLower(strings.TrimPrefix(imgext.Ext(fn), "."))
+	var typ string
+	var fi os.FileInfo
+	var corrupt, err error
+	newFN := normalizeStem(fn)
+	var trusted skipReason
+	switch {
+	case *onlyIfInvalid && isImageExt(ext):
+		trusted = reasonValidExt
+	case *trustKnownExts && isImageExt(ext):
+		trusted = reasonTrustedExt
+	case candidateExts != nil && !candidateExts[ext]:
+		trusted = reasonNotCandidate
+	}
+	if trusted != reasonNone {
+		// Assume the extension is correct, and avoid opening the file. It
+		// need only be stat'ed if it is to be moved to --dest-dir, or
+		// renamed per --normalize-unicode.
+		if *destDir == "" && newFN == fn {
+			return result{Path: fn, Action: actionUnchanged, Reason: trusted}
+		}
+		if fi, err = os.Stat(fn); err != nil {
+			return result{Path: fn, Action: actionError, Err: fmt.Errorf("couldn't stat: %w", wrapVanished(err))}
+		}
+	} else {
+		typ, fi, err = classifyFile(fn)
+		if errors.Is(err, imgext.ErrEmpty) {
+			return result{Path: fn, Action: actionEmpty}
+		}
+		// Base64 is plain text, so it is checked for before any
+		// --include-non-images "txt" classification is accepted.
+		if *decodeB64 && (errors.Is(err, imgext.ErrUnsupportedFormat) || err == nil && typ == "txt") {
+			if typ, ok := classifyBase64(fn); ok {
+				return base64Result(fn, typ)
+			}
+		}
+		if err != nil {
+			return result{Path: fn, Action: actionError, Err: err}
+		}
+		newFN = newName(fn, typ)
+		if *checkFullDecode {
+			corrupt = checkDecode(fn)
+		}
+	}
+	if *destDir != "" {
+		if newFN, err = destPath(fn, newFN); err != nil {
+			return result{Path: fn, Action: actionError, Err: err}
+		}
+	}
+	mismatch := *warnMismatch && typ != "" && isMismatch(ext, typ)
+	if filepath.Clean(fn) == newFN {
+		reason := trusted
+		if reason == reasonNone {
+			reason = reasonCorrect
+		}
+		return result{Path: fn, Type: typ, Action: actionUnchanged, Reason: reason, Mismatch: mismatch, Corrupt: corrupt}
+	}
+	return result{
+		Path:     fn,
+		Type:     typ,
+		Rename:   &rename{From: fn, To: newFN, Type: typ, Size: fi.Size(), ModTime: fi.ModTime()},
+		Action:   actionRename,
+		Mismatch: mismatch,
+		Corrupt:  corrupt,
+	}
+}
+
+// isImageExt determines whether the given (lower-cased, dotless) extension is
+// one commonly used for images.
+func isImageExt(ext string) bool {
+	for _, exts := range typeExts {
+		for _, e := range exts {
+			if e == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isMismatch determines whether a file with the given (lower-cased, dotless)
+// extension and detected type "lies" about its type: that is, whether ext is
+// an image extension, but not one used for typ. Animated PNGs, and the
+// --apng-ext extension, are of the PNG type.
+func isMismatch(ext, typ string) bool {
+	if *apngExt != "" {
+		if typ == *apngExt {
+			typ = "png"
+		}
+		if ext == strings.ToLower(*apngExt) {
+			ext = "png"
+		}
+	}
+	known := false
+	for t, exts := range typeExts {
+		for _, e := range exts {
+			if e == ext {
+				if t == typ {
+					return false
+				}
+				known = true
+			}
+		}
+	}
+	return known
+}
+
+// newName returns the name that fn should have, given that it is of type typ.
+func newName(fn, typ string) string {
+	return imgext.NewName(normalizeStem(stripDelimited(fn)), typ)
+}
+
+// stripDelimited strips everything from the first --strip-query-and-fragment
+// delimiter in fn's final path element onward, cleaning up downloaded names
+// such as "image.php?id=5.jpg" or "photo.jpg@2x". Nothing is stripped if that
+// would leave the element empty.
+func stripDelimited(fn string) string {
+	if *stripDelims == "" {
+		return fn
+	}
+	dir, base := filepath.Split(fn)
+	if i := strings.IndexAny(base, *stripDelims); i > 0 {
+		return dir + base[:i]
+	}
+	return fn
+}
+
+// classifyFile determines the type of the image in the named file, returning
+// the extension (without a leading dot) that it should have, along with the
+// file's info.
+func classifyFile(fn string) (string, os.FileInfo, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't open: %w", wrapVanished(err))
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't stat: %w", err)
+	}
+	if fi.Mode().IsRegular() && fi.Size() == 0 {
+		return "", nil, imgext.ErrEmpty
+	}
+	typ, err := classifier.ClassifyName(throttle(f), fn)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't classify: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, fmt.Errorf("couldn't close: %w", err)
+	}
+	return typ, fi, nil
+}
+
+// checkDecode fully decodes the image in the named file, per
+// --check-full-decode, returning an error if it is truncated or otherwise
+// corrupt. Files in formats which the registered decoders cannot decode, such
+// as RAW formats, are not checked.
+func checkDecode(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("couldn't open: %w", wrapVanished(err))
+	}
+	defer f.Close()
+	if _, _, err := image.Decode(bufio.NewReader(throttle(f))); err != nil && !errors.Is(err, image.ErrFormat) {
+		return err
+	}
+	return nil
+}
+
+// imageReader is the interface required of the source of an image to be
+// classified.
+type imageReader interface {
+	io.Reader
+	io.ReaderAt
+}
+
+// hash returns a hex-encoded hash of the sources & destinations of the renames
+// in p, which are sorted by source, so that equal sets of renames have equal
+// hashes.
+func (p *plan) hash() string {
+	h := sha256.New()
+	for _, r := range p.Renames {
+		fmt.Fprintf(h, "%s\x00%s\x00", r.From, r.To)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stats returns counts describing p, for runs which stop once p is planned.
+func (p *plan) stats() stats {
+	st := stats{
+		renamed:     len(p.Renames),
+		errors:      len(p.Errors),
+		discovered:  len(p.results),
+		durations:   fileDurations(p.results),
+		skipReasons: map[string]int{},
+		failed:      p.Errors,
+	}
+	for _, res := range p.results {
+		switch res.Action {
+		case actionRename, actionError:
+		default:
+			st.skipped++
+			st.skipReasons[skipKey(res)]++
+		}
+		if res.Action == actionCancelled {
+			st.cancelled++
+		}
+	}
+	return st
+}
+
+// findConflicts returns the destinations among the given renames which are
+// the target of more than one rename, or which already exist.
+func findConflicts(renames []rename) []conflict {
+	froms := map[string][]string{}
+	for _, r := range renames {
+		froms[r.To] = append(froms[r.To], r.From)
+	}
+	conflicts := []conflict{}
+	for to, fs := range froms {
+		exists := false
+		if toFI, err := os.Lstat(to); err == nil {
+			// On case-insensitive filesystems, a case-only rename's destination "exists" as the source.
+			exists = true
+			if len(fs) == 1 {
+				if fromFI, err := os.Lstat(fs[0]); err == nil && os.SameFile(fromFI, toFI) {
+					exists = false
+				}
+			}
+		}
+		if len(fs) > 1 || exists {
+			sort.Strings(fs)
+			conflicts = append(conflicts, conflict{To: to, From: fs, Exists: exists})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].To < conflicts[j].To })
+	return conflicts
+}
+
+// readPlan reads a plan document, as written by --dry_run --json.
+func readPlan(fn string) (*plan, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var p plan
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, fmt.Errorf("couldn't parse: %w", err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d (want %d)", p.Version, planVersion)
+	}
+	p.results = make([]result, len(p.Renames))
+	for i := range p.Renames {
+		r := &p.Renames[i]
+		p.results[i] = result{Path: r.From, Type: r.Type, Rename: r, Action: actionRename}
+	}
+	return &p, nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkMakePlan measures the throughput of classifying many small files,
+// for which the overhead of handing files to workers dominates, with both an
+// unbuffered and a buffered (per feedBuffer) channel to the workers.
+func BenchmarkMakePlan(b *testing.B) {
+	dir := b.TempDir()
+	files := map[string][]byte{}
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("%04d.bin", i)] = pngData
+	}
+	writeFiles(b, dir, files)
+	fns := map[string]struct{}{}
+	for name := range files {
+		fns[filepath.Join(dir, name)] = struct{}{}
+	}
+
+	for _, buf := range []int{0, feedBuffer} {
+		for _, conc := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("buffer=%dN/concurrency=%d", buf, conc), func(b *testing.B) {
+				oldConc, oldBuf := *concurrency, feedBuffer
+				*concurrency, feedBuffer = conc, buf
+				defer func() { *concurrency, feedBuffer = oldConc, oldBuf }()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ctx, cancel := context.WithCancel(context.Background())
+					if p := makePlan(ctx, fns, newErrorBudget(0, cancel)); len(p.Renames) != len(fns) {
+						b.Fatalf("Planned %d renames, want %d", len(p.Renames), len(fns))
+					}
+					cancel()
+				}
+				b.ReportMetric(float64(b.N*len(fns))/b.Elapsed().Seconds(), "files/s")
+			})
+		}
+	}
+}
+
+func TestCheckFullDecode(t *testing.T) {
+	// A PNG truncated partway through its image data: its header, and so
+	// image.DecodeConfig, is still valid.
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7 % 251)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:buf.Len()/2]
+	if _, _, err := image.DecodeConfig(bytes.NewReader(truncated)); err != nil {
+		t.Fatalf("DecodeConfig of truncated PNG: %v", err)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("Decode of truncated PNG succeeded, want an error")
+	}
+
+	for _, check := range []bool{false, true} {
+		t.Run(fmt.Sprintf("check-full-decode=%t", check), func(t *testing.T) {
+			setFlags(t, "check-full-decode", fmt.Sprint(check))
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"truncated.bin": truncated, "ok.bin": pngData})
+			st, results := run(t, dir)
+			// Corrupt files are still renamed, but are reported.
+			if st.renamed != 2 || st.errors != 0 {
+				t.Errorf("Got %d renamed & %d errors, want 2 & 0", st.renamed, st.errors)
+			}
+			wantCorrupt := 0
+			if check {
+				wantCorrupt = 1
+			}
+			if st.corrupt != wantCorrupt {
+				t.Errorf("Got %d corrupt files, want %d", st.corrupt, wantCorrupt)
+			}
+			for _, res := range results {
+				if wantErr := check && filepath.Base(res.Path) == "truncated.bin"; (res.Corrupt != nil) != wantErr {
+					t.Errorf("%s: Corrupt = %v, want error: %t", res.Path, res.Corrupt, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipReasons(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		file  string
+		data  []byte // or nil for a file which cannot be opened
+		flags []string
+		want  string
+	}{
+		{"correct", "ok.png", pngData, nil, "already correct"},
+		// Files skipped by extension are never opened: these are dangling
+		// symlinks, which would fail to be classified.
+		{"trusted", "wrong.png", nil, []string{"trust-known-extensions", "true"}, "extension trusted per --trust-known-extensions"},
+		{"valid", "wrong.jpg", nil, []string{"rename-only-if-invalid", "true"}, "extension is already a valid image extension per --rename-only-if-invalid"},
+		{"not a candidate", "pic.dat", nil, []string{"candidates", "bin, .IMG"}, "filtered by extension per --candidates"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.flags...)
+			dir := t.TempDir()
+			if test.data != nil {
+				writeFiles(t, dir, map[string][]byte{test.file: test.data})
+			} else if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, test.file)); err != nil {
+				t.Fatal(err)
+			}
+			_, results := run(t, dir)
+			if len(results) != 1 {
+				t.Fatalf("Got %d results, want 1", len(results))
+			}
+			if res := results[0]; res.Action != actionUnchanged || res.Reason.String() != test.want {
+				t.Errorf("Got action %v (error %v) with reason %q, want %v with reason %q", res.Action, res.Err, res.Reason, actionUnchanged, test.want)
+			}
+
+			// The reason is also given by --dry_run --verbose.
+			args := append([]string{"--dry_run", "--verbose"}, flagArgs(test.flags)...)
+			out, _ := runMain(t, dir, nil, append(args, test.file)...)
+			if want := fmt.Sprintf("Skipping %q: %s", test.file, test.want); !strings.Contains(out, want) {
+				t.Errorf("Output does not contain %q:\n%s", want, out)
+			}
+		})
+	}
+}
+
+func TestParseCandidates(t *testing.T) {
+	if got := parseCandidates(""); got != nil {
+		t.Errorf("parseCandidates(\"\") = %v, want nil", got)
+	}
+	if got, want := parseCandidates("bin, .DAT,img"), map[string]bool{"bin": true, "dat": true, "img": true}; !maps.Equal(got, want) {
+		t.Errorf("parseCandidates = %v, want %v", got, want)
+	}
+}
+
+// flagArgs returns the command-line arguments setting the given flags, as
+// name/value pairs.
+func flagArgs(kv []string) []string {
+	var args []string
+	for i := 0; i < len(kv); i += 2 {
+		args = append(args, fmt.Sprintf("--%s=%s", kv[i], kv[i+1]))
+	}
+	return args
+}
+
+func TestFeedBatches(t *testing.T) {
+	fns := []string{"a/1", "a/2", "a/b/1", "b/1", "b/2", "c"}
+	for _, test := range []struct {
+		batchByDir bool
+		want       [][]int
+	}{
+		{false, [][]int{{0, 1, 2, 3, 4, 5}}},
+		{true, [][]int{{5}, {0, 1}, {2}, {3, 4}}}, // directories ".", "a", "a/b", "b"
+	} {
+		setFlags(t, "batch-by-dir", fmt.Sprint(test.batchByDir))
+		if got := feedBatches(fns); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("With --batch-by-dir=%t: feedBatches = %v, want %v", test.batchByDir, got, test.want)
+		}
+	}
+}
+
+// BenchmarkBatchByDir measures the throughput of classifying & renaming a tree
+// of many directories, with & without --batch-by-dir. The tree is created
+// under $TMPDIR, which should be set to the filesystem of interest: on those
+// without metadata contention (such as tmpfs), batching only adds idle time at
+// the end of each directory.
+func BenchmarkBatchByDir(b *testing.B) {
+	const dirs, perDir = 50, 20
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch-by-dir=%t", batch), func(b *testing.B) {
+			oldBatch, oldConc := *batchByDir, *concurrency
+			*batchByDir, *concurrency = batch, 8
+			defer func() { *batchByDir, *concurrency = oldBatch, oldConc }()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				root := b.TempDir()
+				files := map[string][]byte{}
+				for d := 0; d < dirs; d++ {
+					for f := 0; f < perDir; f++ {
+						files[fmt.Sprintf("%02d/%02d.bin", d, f)] = pngData
+					}
+				}
+				writeFiles(b, root, files)
+				fns := map[string]struct{}{}
+				for name := range files {
+					fns[filepath.Join(root, name)] = struct{}{}
+				}
+				b.StartTimer()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				budget := newErrorBudget(0, cancel)
+				p := makePlan(ctx, fns, budget)
+				if st := handle(ctx, &recorder{}, p.results, false, budget); st.renamed != len(fns) {
+					b.Fatalf("Renamed %d files, want %d", st.renamed, len(fns))
+				}
+				cancel()
+			}
+			b.ReportMetric(float64(b.N*dirs*perDir)/b.Elapsed().Seconds(), "files/s")
+		})
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		flags      []string
+		wantAction action
+		wantFiles  []string
+	}{
+		{"skipped", nil, actionEmpty, []string{"empty.png", "zero.bin"}},
+		{"removed", []string{"remove-empty", "true"}, actionRemoved, nil},
+		{"removed, dry run", []string{"remove-empty", "true", "dry_run", "true"}, actionWouldRemove, []string{"empty.png", "zero.bin"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.flags...)
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"zero.bin": nil, "empty.png": {}})
+			st, results := run(t, dir)
+			for _, res := range results {
+				// Not a decode error.
+				if res.Action != test.wantAction || res.Err != nil {
+					t.Errorf("%s: got action %v (err = %v), want %v", res.Path, res.Action, res.Err, test.wantAction)
+				}
+			}
+			if st.errors != 0 {
+				t.Errorf("Got %d errors, want 0", st.errors)
+			}
+			if got := listFiles(t, dir); !slices.Equal(got, test.wantFiles) {
+				t.Errorf("Files afterward = %q, want %q", got, test.wantFiles)
+			}
+		})
+	}
+
+	// Empty files have their own count in the plan.
+	setFlags(t, "concurrency", "1")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"zero.bin": nil, "pic.bin": pngData})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := makePlan(ctx, map[string]struct{}{filepath.Join(dir, "zero.bin"): {}, filepath.Join(dir, "pic.bin"): {}}, newErrorBudget(0, cancel))
+	if want := (summary{Files: 2, Renames: 1, Empty: 1}); p.Summary != want {
+		t.Errorf("Plan summary = %+v, want %+v", p.Summary, want)
+	}
+}
+
+func TestIncludeNonImages(t *testing.T) {
+	pdfData := []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n%%EOF\n")
+	b64 := []byte(base64.StdEncoding.EncodeToString(pngData) + "\n")
+	for _, test := range []struct {
+		name  string
+		flags []string
+		want  []string
+	}{
+		{"alone", nil, []string{"doc.pdf", "encoded.txt", "notes.txt", "pic.png"}},
+		// Base64-encoded images are text, but are reported as images, and
+		// so are not renamed.
+		{"with --decode-base64", []string{"decode-base64", "true"}, []string{"doc.pdf", "encoded.dat", "notes.txt", "pic.png"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, append([]string{"include-non-images", "true"}, test.flags...)...)
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string][]byte{"doc.bin": pdfData, "notes.bin": textData, "pic.bin": pngData, "encoded.dat": b64})
+			st, _ := run(t, dir)
+			if st.errors != 0 {
+				t.Errorf("Got %d errors, want 0", st.errors)
+			}
+			if got := listFiles(t, dir); !slices.Equal(got, test.want) {
+				t.Errorf("Files afterward = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIncludeNonImagesKeepsAliases(t *testing.T) {
+	setFlags(t, "include-non-images", "true")
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"report.docx": []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00"),
+		"icon.svg":    []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`),
+		"data.csv":    []byte("a,b\n1,2\n"),
+		"cfg.json":    []byte(`{"a": 1}`),
+		"run.sh":      []byte("#!/bin/sh\necho hi\n"),
+	}
+	writeFiles(t, dir, files)
+	st, _ := run(t, dir)
+	if st.renamed != 0 || st.errors != 0 {
+		t.Errorf("Got %d renamed & %d errors, want 0 & 0", st.renamed, st.errors)
+	}
+	if got, want := listFiles(t, dir), []string{"cfg.json", "data.csv", "icon.svg", "report.docx", "run.sh"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
+
+func TestAPNGMismatch(t *testing.T) {
+	// An APNG: a PNG with an acTL chunk before its image data.
+	acTL := binary.BigEndian.AppendUint32(nil, 8)
+	acTL = append(acTL, "acTL\x00\x00\x00\x02\x00\x00\x00\x00"...)
+	acTL = binary.BigEndian.AppendUint32(acTL, crc32.ChecksumIEEE(acTL[4:]))
+	i := bytes.Index(pngData, []byte("IDAT")) - 4
+	apngData := append(append(append([]byte{}, pngData[:i]...), acTL...), pngData[i:]...)
+
+	setFlags(t, "apng-ext", "apng", "warn-mismatch", "true")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"anim.png": apngData, "ok.apng": apngData, "still.apng": pngData, "lies.gif": apngData})
+	st, results := run(t, dir)
+	if st.errors != 0 {
+		t.Errorf("Got %d errors, want 0", st.errors)
+	}
+	if got, want := listFiles(t, dir), []string{"anim.apng", "lies.apng", "ok.apng", "still.png"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+	for _, res := range results {
+		// Only the GIF extension belongs to another type.
+		if want := filepath.Base(res.Path) == "lies.gif"; res.Mismatch != want {
+			t.Errorf("%s: Mismatch = %t, want %t", res.Path, res.Mismatch, want)
+		}
+	}
+}
+
+func TestStripDelimited(t *testing.T) {
+	setFlags(t, "strip-query-and-fragment", "?#@")
+	for _, test := range []struct{ fn, want string }{
+		{"image.php?id=5.jpg", "image.php"},
+		{"photo.jpg@2x", "photo.jpg"},
+		{"pic.png#frag", "pic.png"},
+		{"a?b#c@d", "a"},
+		{filepath.Join("dir?x", "pic.bin"), filepath.Join("dir?x", "pic.bin")}, // only the final element is stripped
+		{"?only.bin", "?only.bin"}, // stripping would leave nothing
+		{"plain.bin", "plain.bin"},
+	} {
+		if got := stripDelimited(test.fn); got != test.want {
+			t.Errorf("stripDelimited(%q) = %q, want %q", test.fn, got, test.want)
+		}
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"image.php?id=5.jpg": pngData,
+		"photo.jpg@2x":       jpegData,
+		"pic.gif#frag":       gifData,
+		"?only.bin":          pngData,
+		// These both strip to "dup.bin", and so collide.
+		"dup.bin?a": pngData,
+		"dup.bin?b": pngData,
+	})
+	st, _ := run(t, dir)
+	if st.renamed != 5 || st.errors != 1 {
+		t.Errorf("Got %d renamed & %d errors, want 5 & 1", st.renamed, st.errors)
+	}
+	if got, want := listFiles(t, dir), []string{"?only.png", "dup.bin?b", "dup.png", "image.png", "photo.jpg", "pic.gif"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
+
+func TestTrustedExtensions(t *testing.T) {
+	// --rename-only-if-invalid is equivalent, but for the reason reported.
+	for _, name := range []string{"trust-known-extensions", "rename-only-if-invalid"} {
+		t.Run(name, func(t *testing.T) {
+			setFlags(t, name, "true")
+			dir := t.TempDir()
+			// Files with unrecognized extensions, or none, are still read &
+			// renamed; those with image extensions are left alone, even if
+			// wrong.
+			writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "noext": gifData, "wrong.jpg": gifData, "ok.png": pngData})
+			st, _ := run(t, dir)
+			if st.renamed != 2 || st.errors != 0 {
+				t.Errorf("Got %d renamed & %d errors, want 2 & 0", st.renamed, st.errors)
+			}
+			if got, want := listFiles(t, dir), []string{"a.png", "noext.gif", "ok.png", "wrong.jpg"}; !slices.Equal(got, want) {
+				t.Errorf("Files afterward = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseTypeConcurrency(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		want    map[string]int // or nil for an error
+		wantErr string
+	}{
+		{s: "tiff:1", want: map[string]int{"tiff": 1}},
+		{s: " .TIF : 2 ,default:8", want: map[string]int{"tiff": 2, "default": 8}},
+		// Extensions are keyed by type, where known.
+		{s: "jpeg:1,png:3,bin:2", want: map[string]int{"jpg": 1, "png": 3, "bin": 2}},
+		{s: "tiff", wantErr: "not of the form ext:N"},
+		{s: "tiff:0", wantErr: "bad limit"},
+		{s: "tiff:-1", wantErr: "bad limit"},
+		{s: "tiff:x", wantErr: "bad limit"},
+		{s: "tiff:1,tiff:2", wantErr: "listed more than once"},
+		{s: "tif:1,tiff:2", wantErr: `extensions "tif" and "tiff" are of the same type`},
+	} {
+		got, err := parseTypeConcurrency(test.s)
+		switch {
+		case test.want != nil && (err != nil || !maps.Equal(got, test.want)):
+			t.Errorf("parseTypeConcurrency(%q) = %v, %v; want %v, nil", test.s, got, err, test.want)
+		case test.want == nil && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("parseTypeConcurrency(%q) error = %v, want one containing %q", test.s, err, test.wantErr)
+		}
+	}
+}
+
+func TestFeedTypeConcurrency(t *testing.T) {
+	setFlags(t, "type-concurrency", "tiff:1,default:1")
+	fns := []string{"a.tif", "b.tiff", "c.png", "d.png", "e.jpg"}
+	ch := make(chan int)
+	var batch sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		feed(context.Background(), fns, ch, &batch)
+	}()
+	recv := func(want int) {
+		t.Helper()
+		select {
+		case i := <-ch:
+			if i != want {
+				t.Fatalf("Got file %q, want %q", fns[i], fns[want])
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for file %q", fns[want])
+		}
+	}
+	finish := func(i int) {
+		releaseTypeSem(fns[i])
+		batch.Done()
+	}
+
+	// While a TIFF is being worked on, the other (which shares its limit,
+	// though its extension differs) is held back, but other types are not.
+	recv(0)
+	recv(2)
+	// Unlisted types share the default limit.
+	finish(2)
+	recv(3)
+	finish(3)
+	recv(4)
+	finish(0)
+	recv(1)
+	finish(1)
+	finish(4)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for feed to finish")
+	}
+}
+
+func TestTypeConcurrencyRun(t *testing.T) {
+	setFlags(t, "type-concurrency", "tiff:1,jpg:1", "concurrency", "4")
+	files := map[string][]byte{}
+	var want []string
+	for i := 0; i < 20; i++ {
+		// The limited files sort first, and so are fed to the workers first.
+		files[fmt.Sprintf("a%02d.jpeg", i)] = jpegData
+		files[fmt.Sprintf("b%02d.bin", i)] = pngData
+		want = append(want, fmt.Sprintf("a%02d.jpg", i))
+	}
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("b%02d.png", i))
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	st, _ := run(t, dir)
+	if st.renamed != 40 || st.errors != 0 {
+		t.Errorf("Got %d renamed & %d errors, want 40 & 0", st.renamed, st.errors)
+	}
+	if got := listFiles(t, dir); !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// readLimiter, if non-nil, limits the aggregate rate at which file contents
+// are read, per --max-read-bytes-per-sec.
+var readLimiter *rateLimiter
+
+// rateLimiter is a token-bucket limiter on a number of bytes per second, safe
+// for concurrent use. The bucket holds up to one second's worth of tokens.
+//
+// Callers take tokens after the fact, for bytes they have already read, and
+// may drive the bucket into debt; each caller then sleeps until its share of
+// the debt is repaid. This way a single large read can never deadlock waiting
+// for more tokens than the bucket can hold, and since the lock is never held
+// while sleeping, any number of goroutines may wait at once.
+type rateLimiter struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// take takes n tokens from the bucket, sleeping until the bucket is out of
+// debt.
+func (l *rateLimiter) take(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledReader limits reads from an underlying reader using a rateLimiter.
+// It intentionally implements only Read & ReadAt, so that io.Copy & friends
+// cannot bypass the limit via WriterTo.
+type throttledReader struct {
+	r imageReader
+	l *rateLimiter
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.l.take(n)
+	return n, err
+}
+
+func (t throttledReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.r.ReadAt(p, off)
+	t.l.take(n)
+	return n, err
+}
+
+// throttle wraps r such that reads respect --max-read-bytes-per-sec.
+func throttle(r imageReader) imageReader {
+	if readLimiter == nil {
+		return r
+	}
+	return throttledReader{r, readLimiter}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, from linux/fs.h.
+const ficlone = 0x40049409
+
+// cloneFile makes dst a copy-on-write clone of src via the FICLONE ioctl, as
+// supported by e.g. btrfs & XFS.
+func cloneFile(dst, src *os.File) error {
+	conn, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, ficlone, src.Fd())
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isCloneUnsupported determines whether err, returned by cloneFile, indicates
+// that the files cannot be cloned (rather than that cloning failed).
+func isCloneUnsupported(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errCloneUnsupported = errors.New("reflinks are only implemented on Linux")
+
+// cloneFile would make dst a copy-on-write clone of src, but this is not
+// implemented on this platform.
+func cloneFile(dst, src *os.File) error { return errCloneUnsupported }
+
+// isCloneUnsupported determines whether err, returned by cloneFile, indicates
+// that the files cannot be cloned (rather than that cloning failed).
+func isCloneUnsupported(err error) bool { return errors.Is(err, errCloneUnsupported) }
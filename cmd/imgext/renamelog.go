@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// renameLogger, if non-nil, records performed renames per --rename-log.
+var renameLogger *renameLog
+
+// renameLog appends a timestamped line to a log file for each rename
+// performed, rotating the file once it would exceed a maximum size. It is safe
+// for concurrent use. The file is not opened (or created) until the first
+// rename is recorded.
+type renameLog struct {
+	path    string
+	maxSize int64 // 0 if the log is never rotated
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRenameLog(path string, maxSize int64) *renameLog {
+	return &renameLog{path: path, maxSize: maxSize}
+}
+
+// record appends a line for the given rename, of the form
+// "<RFC 3339 time>\t<old path>\t<new path>". Paths are made absolute, so that
+// logs from runs in different directories may be compared.
+func (l *renameLog) record(r rename) error {
+	from, to := r.From, r.To
+	if abs, err := filepath.Abs(from); err == nil {
+		from = abs
+	}
+	if abs, err := filepath.Abs(to); err == nil {
+		to = abs
+	}
+	line := fmt.Sprintf("%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339Nano), from, to)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.WriteString(line)
+	l.size += int64(n)
+	return err
+}
+
+// open opens the log file for appending, creating it if necessary.
+func (l *renameLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the current log file aside, to the same name with ".1"
+// appended (replacing any previous such file), and starts a new one.
+func (l *renameLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// close closes the log file, if it was opened.
+func (l *renameLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
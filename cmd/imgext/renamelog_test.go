@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readLog returns the lines of the named log file, with each line's timestamp
+// checked & stripped.
+func readLog(t *testing.T, fn string) []string {
+	t.Helper()
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		ts, rest, ok := strings.Cut(line, "\t")
+		if _, err := time.Parse(time.RFC3339Nano, ts); !ok || err != nil || !strings.HasSuffix(rest, "\n") {
+			t.Errorf("%s: malformed line %q", fn, line)
+		}
+		lines = append(lines, strings.TrimSuffix(rest, "\n"))
+	}
+	return lines
+}
+
+func TestRenameLogAppends(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "renames.log")
+	for i := 0; i < 2; i++ { // two runs
+		l := newRenameLog(fn, 0)
+		if err := l.record(rename{From: filepath.Join(dir, fmt.Sprintf("%d.bin", i)), To: filepath.Join(dir, fmt.Sprintf("%d.png", i))}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		filepath.Join(dir, "0.bin") + "\t" + filepath.Join(dir, "0.png"),
+		filepath.Join(dir, "1.bin") + "\t" + filepath.Join(dir, "1.png"),
+	}
+	if got := readLog(t, fn); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Log = %q, want %q", got, want)
+	}
+}
+
+func TestRenameLogRotates(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "renames.log")
+	r := func(i int) rename {
+		return rename{From: filepath.Join(dir, fmt.Sprintf("%d.bin", i)), To: filepath.Join(dir, fmt.Sprintf("%d.png", i))}
+	}
+	lineLen := int64(len(fmt.Sprintf("%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339Nano), r(0).From, r(0).To)))
+
+	// Each log holds up to two lines (give or take the length of the
+	// timestamp, which varies).
+	l := newRenameLog(fn, 2*lineLen+lineLen/2)
+	for i := 0; i < 5; i++ {
+		if err := l.record(r(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines 0 & 1 were rotated to renames.log.1, then replaced by lines 2 & 3.
+	line := func(i int) string { return r(i).From + "\t" + r(i).To }
+	if got, want := readLog(t, fn+".1"), []string{line(2), line(3)}; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Rotated log = %q, want %q", got, want)
+	}
+	if got, want := readLog(t, fn), []string{line(4)}; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Log = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(fn + ".2"); err == nil {
+		t.Errorf("%s.2 exists; only one rotated log is kept", fn)
+	}
+}
+
+func TestRenameLogConcurrent(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "renames.log")
+	l := newRenameLog(fn, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := l.record(rename{From: fmt.Sprintf("/src/%d.bin", i), To: fmt.Sprintf("/src/%d.png", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, fn); len(got) != 100 {
+		t.Errorf("Log has %d lines, want 100", len(got))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// action describes what was (or will be) done with a file.
+type action int
+
+const (
+	actionUnchanged    action = iota // the file already has the correct extension
+	actionRename                     // the file is to be renamed
+	actionWouldRename                // the file would have been renamed, but --dry_run is set
+	actionError                      // the file could not be handled
+	actionCancelled                  // the file was not handled, because the run was cancelled
+	actionRolledBack                 // the file was renamed, but the rename was undone per --transactional
+	actionEmpty                      // the file is empty, so has no type
+	actionRemoved                    // the file was empty, and was removed per --remove-empty
+	actionWouldRemove                // the file would have been removed per --remove-empty, but --dry_run is set
+	actionBase64                     // the file holds a base64-encoded image, per --decode-base64
+	actionConverted                  // the file held a base64-encoded image, which was decoded per --convert
+	actionWouldConvert               // the file's base64-encoded image would have been decoded per --convert, but --dry_run is set
+)
+
+func (a action) String() string {
+	switch a {
+	case actionUnchanged:
+		return "unchanged"
+	case actionRename:
+		return "rename"
+	case actionWouldRename:
+		return "would-rename"
+	case actionError:
+		return "error"
+	case actionCancelled:
+		return "cancelled"
+	case actionRolledBack:
+		return "rolled-back"
+	case actionEmpty:
+		return "empty"
+	case actionRemoved:
+		return "removed"
+	case actionWouldRemove:
+		return "would-remove"
+	case actionBase64:
+		return "base64"
+	case actionConverted:
+		return "converted"
+	case actionWouldConvert:
+		return "would-convert"
+	default:
+		return fmt.Sprintf("action(%d)", int(a))
+	}
+}
+
+// skipReason describes why a file is left unchanged.
+type skipReason int
+
+const (
+	reasonNone         skipReason = iota // the file is not left unchanged, or no reason is known (e.g. from --apply-plan)
+	reasonCorrect                        // the file's extension matches its content
+	reasonTrustedExt                     // the file has an image extension, trusted per --trust-known-extensions
+	reasonValidExt                       // the file has an image extension, kept per --rename-only-if-invalid
+	reasonNotCandidate                   // the file's extension is not listed in --candidates
+)
+
+func (r skipReason) String() string {
+	switch r {
+	case reasonNone:
+		return "unknown"
+	case reasonCorrect:
+		return "already correct"
+	case reasonTrustedExt:
+		return "extension trusted per --trust-known-extensions"
+	case reasonValidExt:
+		return "extension is already a valid image extension per --rename-only-if-invalid"
+	case reasonNotCandidate:
+		return "filtered by extension per --candidates"
+	default:
+		return fmt.Sprintf("skipReason(%d)", int(r))
+	}
+}
+
+// result describes the outcome of handling a single file.
+type result struct {
+	Path   string  // the file's path
+	Type   string  // the file's detected type, or "" if it could not be classified
+	Rename *rename // the file's rename, or nil if it is not to be renamed
+	Action action
+	Err    error      // set iff Action is actionError
+	Reason skipReason // set if Action is actionUnchanged
+
+	// Hook is the --exec command that would have been run for the file, had
+	// --dry_run not been set.
+	Hook []string
+
+	// Mismatch is set if the file's extension belongs to an image type other
+	// than its detected type. It is only computed if --warn-mismatch is set.
+	Mismatch bool
+
+	// Corrupt is the error encountered fully decoding the file, if its header
+	// is valid but its content is truncated or otherwise corrupt. It is only
+	// computed if --check-full-decode is set.
+	Corrupt error
+
+	// Duration is the time taken to plan the file, or 0 if it was not planned
+	// by this run.
+	Duration time.Duration
+
+	// ChmodErr is the error encountered setting the permissions of the file at
+	// its new path per --chmod, if any. The file is still renamed (or
+	// converted).
+	ChmodErr error
+
+	// resumeErr is the error encountered recording the file in the --resume
+	// state file, if any.
+	resumeErr error
+}
+
+// reporter reports results to the user.
+type reporter interface {
+	// begin is called once, before any results are reported.
+	begin(fileCount int)
+	// report is called once per file, in path order.
+	report(res result)
+	// finish is called once, after all results have been reported.
+	finish() error
+}
+
+// newReporter returns a reporter for the given --report format.
+func newReporter(format string) (reporter, error) {
+	switch format {
+	case "text":
+		return textReporter{}, nil
+	case "csv":
+		return &csvReporter{w: csv.NewWriter(os.Stdout)}, nil
+	default:
+		return nil, fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// textReporter reports results as human-readable text: renames are written to
+// stdout (along with files left unchanged, and why, if --verbose is set),
+// and errors & rolled-back renames to stderr. When written to a
+// terminal, renames are colored green, errors red, and skips & rollbacks
+// yellow.
+type textReporter struct{}
+
+func (textReporter) begin(fileCount int) { fmt.Printf("Renaming %d file(s)\n", fileCount) }
+
+func (textReporter) report(res result) {
+	switch res.Action {
+	case actionRename, actionWouldRename:
+		fmt.Println(paint(stdoutColor, ansiGreen, fmt.Sprintf("%s -> %s", displayPath(res.Path), displayPath(res.Rename.To))))
+		if res.Action == actionWouldRename && *chmodFlag != "" {
+			fmt.Printf("  would chmod: %s\n", *chmodFlag)
+		}
+		reportChmodErr(res)
+		if res.Hook != nil {
+			fmt.Printf("  would run: %s\n", strings.Join(res.Hook, " "))
+		}
+	case actionError:
+		fmt.Fprintln(os.Stderr, paint(stderrColor, ansiRed, fmt.Sprintf("Couldn't handle %q: %v", displayPath(res.Path), res.Err)))
+	case actionUnchanged:
+		if *verbose {
+			fmt.Println(paint(stdoutColor, ansiYellow, fmt.Sprintf("Skipping %q: %v", displayPath(res.Path), res.Reason)))
+		}
+	case actionEmpty:
+		fmt.Println(paint(stdoutColor, ansiYellow, fmt.Sprintf("Skipping empty file %q", displayPath(res.Path))))
+	case actionRemoved, actionWouldRemove:
+		fmt.Println(paint(stdoutColor, ansiYellow, fmt.Sprintf("Removing empty file %q", displayPath(res.Path))))
+	case actionBase64:
+		fmt.Printf("%s holds base64-encoded %s data (use --convert to decode it to %s)\n", displayPath(res.Path), res.Type, displayPath(res.Rename.To))
+	case actionConverted, actionWouldConvert:
+		fmt.Println(paint(stdoutColor, ansiGreen, fmt.Sprintf("%s => %s (decoded from base64)", displayPath(res.Path), displayPath(res.Rename.To))))
+		if res.Action == actionWouldConvert && *chmodFlag != "" {
+			fmt.Printf("  would chmod: %s\n", *chmodFlag)
+		}
+		reportChmodErr(res)
+	case actionCancelled:
+		if *verbose {
+			fmt.Println(paint(stdoutColor, ansiYellow, fmt.Sprintf("Skipping %q: the run was cancelled", displayPath(res.Path))))
+		}
+	case actionRolledBack:
+		fmt.Fprintln(os.Stderr, paint(stderrColor, ansiYellow, fmt.Sprintf("Rolled back %s -> %s", displayPath(res.Path), displayPath(res.Rename.To))))
+	}
+}
+
+func (textReporter) finish() error { return nil }
+
+// reportChmodErr reports the --chmod failure for res, if any, to stderr.
+func reportChmodErr(res result) {
+	if res.ChmodErr != nil {
+		fmt.Fprintln(os.Stderr, paint(stderrColor, ansiRed, fmt.Sprintf("Couldn't chmod %q: %v", displayPath(res.Rename.To), res.ChmodErr)))
+	}
+}
+
+// csvReporter reports results as CSV written to stdout, with a header row
+// followed by one row per file.
+type csvReporter struct{ w *csv.Writer }
+
+func (r *csvReporter) begin(int) {
+	r.w.Write([]string{"old_path", "new_path", "detected_type", "action", "error"})
+}
+
+func (r *csvReporter) report(res result) {
+	var newPath, errStr string
+	if res.Rename != nil {
+		newPath = displayPath(res.Rename.To)
+	}
+	switch {
+	case res.Err != nil:
+		errStr = res.Err.Error()
+	case res.ChmodErr != nil:
+		errStr = fmt.Sprintf("couldn't chmod: %v", res.ChmodErr)
+	}
+	r.w.Write([]string{displayPath(res.Path), newPath, res.Type, res.Action.String(), errStr})
+}
+
+func (r *csvReporter) finish() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// displayPath returns the form of path p to be shown to the user: relative to
+// --relative-to, if that is set.
+func displayPath(p string) string {
+	if *relativeTo == "" {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	rel, err := filepath.Rel(*relativeTo, abs)
+	if err != nil {
+		return p
+	}
+	return rel
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCSVReporterEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	rep := &csvReporter{w: csv.NewWriter(&buf)}
+	rep.begin(3)
+	rep.report(result{Path: `a,b.bin`, Type: "png", Rename: &rename{From: `a,b.bin`, To: `a,b.png`}, Action: actionWouldRename})
+	rep.report(result{Path: `say "cheese".dat`, Type: "jpg", Rename: &rename{From: `say "cheese".dat`, To: `say "cheese".jpg`}, Action: actionRename})
+	rep.report(result{Path: "line\nbreak", Action: actionError, Err: errors.New(`couldn't classify: "bad", very bad`)})
+	if err := rep.finish(); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+
+	const want = `old_path,new_path,detected_type,action,error
+"a,b.bin","a,b.png",png,would-rename,
+"say ""cheese"".dat","say ""cheese"".jpg",jpg,rename,
+"line
+break",,,error,"couldn't classify: ""bad"", very bad"
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Got CSV:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The document must also round-trip through a CSV parser.
+	recs, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Couldn't parse CSV: %v", err)
+	}
+	wantRecs := [][]string{
+		{"old_path", "new_path", "detected_type", "action", "error"},
+		{`a,b.bin`, `a,b.png`, "png", "would-rename", ""},
+		{`say "cheese".dat`, `say "cheese".jpg`, "jpg", "rename", ""},
+		{"line\nbreak", "", "", "error", `couldn't classify: "bad", very bad`},
+	}
+	if !slices.EqualFunc(recs, wantRecs, slices.Equal) {
+		t.Errorf("Parsed CSV = %q, want %q", recs, wantRecs)
+	}
+}
+
+func TestRelativeTo(t *testing.T) {
+	// Files are named by absolute globs, from an unrelated directory.
+	dir, wd := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"photos/a.bin": pngData, "other/b.dat": gifData})
+	out, code := runMain(t, wd, nil, "--relative-to="+filepath.Join(dir, "photos"), filepath.Join(dir, "photos", "*"), filepath.Join(dir, "other", "*"))
+	if code != 0 {
+		t.Fatalf("imgext exited with code %d: %s", code, out)
+	}
+	for _, want := range []string{
+		"a.bin -> a.png\n",
+		filepath.FromSlash("../other/b.dat -> ../other/b.gif\n"),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, dir) {
+		t.Errorf("Output contains absolute paths:\n%s", out)
+	}
+	// The files themselves are renamed in place, not relative to the working
+	// directory or --relative-to.
+	if got, want := listFiles(t, dir), []string{"other/b.gif", "photos/a.png"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+	if got := listFiles(t, wd); len(got) != 0 {
+		t.Errorf("Files created in the working directory: %q", got)
+	}
+}
+
+func TestTextReporterColor(t *testing.T) {
+	setFlags(t, "verbose", "true")
+	stdoutColor = true
+	t.Cleanup(func() { stdoutColor = false })
+	out := captureStdout(t, func() {
+		var rep textReporter
+		rep.report(result{Path: "ok.png", Action: actionUnchanged, Reason: reasonCorrect})
+		rep.report(result{Path: "late.bin", Action: actionCancelled})
+		rep.report(result{Path: "empty.bin", Action: actionEmpty})
+		rep.report(result{Path: "a.bin", Rename: &rename{From: "a.bin", To: "a.png"}, Action: actionRename})
+	})
+	want := ansiYellow + `Skipping "ok.png": already correct` + ansiReset + "\n" +
+		ansiYellow + `Skipping "late.bin": the run was cancelled` + ansiReset + "\n" +
+		ansiYellow + `Skipping empty file "empty.bin"` + ansiReset + "\n" +
+		ansiGreen + "a.bin -> a.png" + ansiReset + "\n"
+	if out != want {
+		t.Errorf("Got output %q, want %q", out, want)
+	}
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// resumeState, if non-nil, records & skips completed files per --resume.
+var resumeState *resumeLog
+
+// resumeLog is a state file listing files which have been completely handled,
+// so that an interrupted run may be resumed without handling them again. Each
+// line holds the quoted absolute path of a file as it stands after handling:
+// after a rename, the new path is recorded, since the old one no longer
+// exists. It is safe for concurrent use.
+type resumeLog struct {
+	done map[string]bool // read-only after openResumeLog
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openResumeLog opens the named state file for appending, creating it if
+// necessary, and reads the files it records. Unparseable lines, such as one
+// left half-written by a crash, are ignored.
+func openResumeLog(fn string) (*resumeLog, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	done := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if p, err := strconv.Unquote(s.Text()); err == nil {
+			done[p] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &resumeLog{done: done, f: f}, nil
+}
+
+// completed determines whether the named file was recorded as handled by a
+// previous run. A recorded file which has since been removed is simply not
+// found by the globs, and one which has since been renamed is found under its
+// new name & handled afresh.
+func (l *resumeLog) completed(fn string) bool {
+	abs, err := filepath.Abs(fn)
+	return err == nil && l.done[abs]
+}
+
+// record records that the named file has been handled.
+func (l *resumeLog) record(fn string) error {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = fmt.Fprintln(l.f, strconv.Quote(abs))
+	return err
+}
+
+// close closes the state file.
+func (l *resumeLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// recordPlanned records res, which has just been planned, in resumeState if
+// planning it completely handled the file: that is, if it is to be left
+// unchanged.
+func recordPlanned(res result) error {
+	if res.Action != actionUnchanged {
+		return nil
+	}
+	return resumeState.record(res.Path)
+}
+
+// recordCompleted records res, which has just been handled, in resumeState if
+// it was renamed. Files left unchanged are recorded by recordPlanned instead.
+func recordCompleted(res result) error {
+	if res.Action != actionRename {
+		return nil
+	}
+	return resumeState.record(res.Rename.To)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "ok.png": pngData, "later.bin": gifData})
+	state := filepath.Join(t.TempDir(), "state")
+
+	// A first run, interrupted before later.bin is found (here, because it
+	// is not matched).
+	if out, code := runMain(t, dir, nil, "--resume="+state, "a.bin", "ok.png"); code != 0 {
+		t.Fatalf("First run: exit code = %d, want 0; output:\n%s", code, out)
+	}
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		p, err := strconv.Unquote(line)
+		if err != nil {
+			t.Errorf("Bad state file line %q: %v", line, err)
+		}
+		got = append(got, p)
+	}
+	slices.Sort(got)
+	// The new path of the renamed file is recorded.
+	if want := []string{filepath.Join(dir, "a.png"), filepath.Join(dir, "ok.png")}; !slices.Equal(got, want) {
+		t.Errorf("State file records %q, want %q", got, want)
+	}
+
+	// A corrupted final line, as left by a crash, is ignored, as are
+	// recorded files which no longer exist.
+	f, err := os.OpenFile(state, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(strconv.Quote(filepath.Join(dir, "removed.bin")) + "\n\"" + dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The resumed run skips the files handled by the first, even though
+	// a.png is matched again.
+	out, code := runMain(t, dir, nil, "--resume="+state, "*")
+	if code != 0 {
+		t.Fatalf("Resumed run: exit code = %d, want 0; output:\n%s", code, out)
+	}
+	for _, want := range []string{"Resuming: skipping 2 file(s) handled by a previous run\n", "Renaming 1 file(s)\n", "later.bin -> later.gif\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Resumed run's output does not contain %q:\n%s", want, out)
+		}
+	}
+	if got, want := listFiles(t, dir), []string{"a.png", "later.gif", "ok.png"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
+
+func TestResumeSkipsRecorded(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "b.bin": pngData})
+	state := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(state, []byte(strconv.Quote(filepath.Join(dir, "a.bin"))+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := runMain(t, dir, nil, "--resume="+state, "*"); code != 0 {
+		t.Fatalf("Exit code = %d, want 0; output:\n%s", code, out)
+	}
+	// a.bin is misnamed, but was recorded as handled, so is left alone.
+	if got, want := listFiles(t, dir), []string{"a.bin", "b.png"}; !slices.Equal(got, want) {
+		t.Errorf("Files afterward = %q, want %q", got, want)
+	}
+}
+
+func TestResumeRecordsUnchangedWhenPlanned(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"ok.png": pngData, "a.bin": pngData})
+	setFlags(t, "concurrency", "1")
+	state := filepath.Join(t.TempDir(), "state")
+	l, err := openResumeLog(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeState = l
+	t.Cleanup(func() { resumeState = nil; l.close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	makePlan(ctx, map[string]struct{}{filepath.Join(dir, "ok.png"): {}, filepath.Join(dir, "a.bin"): {}}, newErrorBudget(0, cancel))
+
+	// Before anything is renamed (or a crash prevents it), the unchanged
+	// file is already recorded.
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), strconv.Quote(filepath.Join(dir, "ok.png"))+"\n"; got != want {
+		t.Errorf("State file = %q, want %q", got, want)
+	}
+}
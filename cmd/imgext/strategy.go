@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/BranLwyd/imgext"
+)
+
+// renameStrategies maps from each --rename-strategy to the function placing a
+// file at its new path. Strategies other than "move" leave the original in
+// place, unless --remove-original is set.
+var renameStrategies = map[string]func(from, to string) error{
+	"move":    imgext.OSFileSystem{}.Rename,
+	"link":    linkFile,
+	"reflink": reflinkFile,
+}
+
+// placeFile places the file from at to, per --rename-strategy. If it returns
+// an error, the file has not been placed: in particular, if the original
+// cannot be removed per --remove-original, its new link or copy is removed.
+func placeFile(from, to string) error {
+	if err := renameStrategies[*renameStrategy](from, to); err != nil {
+		return err
+	}
+	if *renameStrategy != "move" && *removeOriginal {
+		if err := os.Remove(from); err != nil {
+			if rmErr := os.Remove(to); rmErr != nil {
+				return fmt.Errorf("couldn't remove original: %w (and couldn't remove %q: %v)", err, to, rmErr)
+			}
+			return fmt.Errorf("couldn't remove original: %w", err)
+		}
+	}
+	return nil
+}
+
+// unplaceFile undoes placeFile(from, to).
+func unplaceFile(from, to string) error {
+	if *renameStrategy != "move" && !*removeOriginal {
+		return os.Remove(to)
+	}
+	return imgext.OSFileSystem{}.Rename(to, from)
+}
+
+// errChanged is returned by placeFS for a source which has changed since it
+// was planned.
+var errChanged = errors.New("file has changed since the plan was created")
+
+// placeFS is the imgext.FileSystem on which files are renamed: files are
+// placed per --rename-strategy, creating any missing destination directories.
+// It maps from the source of each rename which is checked, when stat'ed, to be
+// unchanged since it was planned, to the rename.
+type placeFS map[string]rename
+
+func (p placeFS) Rename(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return fmt.Errorf("couldn't create destination directory: %w", err)
+	}
+	return placeFile(from, to)
+}
+
+func (p placeFS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := os.Lstat(name)
+	if r, ok := p[name]; ok && err == nil && (fi.Size() != r.Size || !fi.ModTime().Equal(r.ModTime)) {
+		return nil, errChanged
+	}
+	return fi, err
+}
+
+// linkFile hard-links from to to, falling back to copying if hard links are
+// not supported.
+func linkFile(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil || !isLinkUnsupported(err) {
+		return err
+	}
+	warnFallback("hard links", err)
+	return copyFile(from, to, false)
+}
+
+// isLinkUnsupported determines whether err, returned by os.Link, indicates
+// that hard links cannot be created between the given paths.
+func isLinkUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EMLINK)
+}
+
+// reflinkFile makes a copy-on-write clone of from at to, falling back to
+// copying if clones are not supported.
+func reflinkFile(from, to string) error { return copyFile(from, to, true) }
+
+// copyFile copies from to to, which must not already exist, preserving its
+// permissions & modification time. If clone is set, the copy is made by
+// cloning from (sharing its storage) where the platform & filesystem allow.
+func copyFile(from, to string, clone bool) (retErr error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(to)
+		}
+	}()
+
+	if clone {
+		if err = cloneFile(dst, src); err != nil && isCloneUnsupported(err) {
+			warnFallback("reflinks", err)
+			clone = false
+		}
+	}
+	if !clone {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
+
+var fallbackOnce sync.Once
+
+// warnFallback warns, once per run, that the given feature is not available
+// and that files are being copied instead.
+func warnFallback(feature string, err error) {
+	fallbackOnce.Do(func() {
+		fmt.Fprintf(os.Stderr, "Warning: %s are not supported here (%v); copying files instead\n", feature, err)
+	})
+}
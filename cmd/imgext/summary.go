@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// summaryDoc is the schema of the JSON document written by --summary-json.
+type summaryDoc struct {
+	Total           int            `json:"total"` // number of files found
+	Renamed         int            `json:"renamed"`
+	Skipped         skippedSummary `json:"skipped"`
+	Errors          errorsSummary  `json:"errors"`
+	DurationSeconds float64        `json:"duration_seconds"`
+}
+
+type skippedSummary struct {
+	Total   int            `json:"total"`
+	Reasons map[string]int `json:"reasons"` // number of files skipped for each reason
+}
+
+type errorsSummary struct {
+	Total int       `json:"total"`
+	Files []fileErr `json:"files"` // files which could not be handled, sorted by path
+}
+
+// skipKey returns the reason under which res, a skipped file, is counted in
+// the --summary-json document.
+func skipKey(res result) string {
+	if res.Action == actionUnchanged {
+		return res.Reason.String()
+	}
+	return res.Action.String()
+}
+
+// writeSummary writes a JSON document summarizing st to the named file, per
+// --summary-json.
+func writeSummary(fn string, st stats) error {
+	doc := summaryDoc{
+		Total:           st.discovered,
+		Renamed:         st.renamed,
+		Skipped:         skippedSummary{Total: st.skipped, Reasons: st.skipReasons},
+		Errors:          errorsSummary{Total: st.errors, Files: st.failed},
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if doc.Skipped.Reasons == nil {
+		doc.Skipped.Reasons = map[string]int{}
+	}
+	if doc.Errors.Files == nil {
+		doc.Errors.Files = []fileErr{}
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, append(data, '\n'), 0666)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSummaryJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a.bin": pngData, "ok.png": pngData, "notes.txt": textData, "empty.dat": nil})
+	fn := filepath.Join(t.TempDir(), "summary.json")
+	if out, code := runMain(t, dir, nil, "--summary-json="+fn, "*"); code != 1 {
+		t.Fatalf("Exit code = %d, want 1; output:\n%s", code, out)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the document's structure...
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Couldn't parse summary: %v", err)
+	}
+	var keys []string
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if want := []string{"duration_seconds", "errors", "renamed", "skipped", "total"}; !slices.Equal(keys, want) {
+		t.Errorf("Summary has keys %q, want %q", keys, want)
+	}
+	if d, ok := doc["duration_seconds"].(float64); !ok || d <= 0 {
+		t.Errorf("duration_seconds = %v, want a positive number", doc["duration_seconds"])
+	}
+
+	// ...and its content.
+	var got summaryDoc
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Couldn't parse summary: %v", err)
+	}
+	got.DurationSeconds = 0
+	if len(got.Errors.Files) == 1 && strings.Contains(got.Errors.Files[0].Error, "unsupported format") {
+		got.Errors.Files[0].Error = "unsupported format"
+	}
+	want := summaryDoc{
+		Total:   4,
+		Renamed: 1,
+		Skipped: skippedSummary{Total: 2, Reasons: map[string]int{"already correct": 1, "empty": 1}},
+		Errors:  errorsSummary{Total: 1, Files: []fileErr{{Path: "notes.txt", Error: "unsupported format"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Summary = %+v, want %+v", got, want)
+	}
+}
+
+func TestSummaryJSONEmpty(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "summary.json")
+	if err := writeSummary(fn, stats{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty collections are written as such, rather than as null.
+	for _, want := range []string{`"reasons": {}`, `"files": []`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Summary does not contain %s:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package imgext
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// contentTypeExts maps from MIME types reported by http.DetectContentType to
+// the extension that files of that type should have, per
+// Classifier.NonImages. Types not listed (notably "application/octet-stream",
+// which DetectContentType reports for unrecognized content) are not renamed.
+var contentTypeExts = map[string]string{
+	"application/pdf":               "pdf",
+	"application/postscript":        "ps",
+	"application/wasm":              "wasm",
+	"application/x-gzip":            "gz",
+	"application/x-rar-compressed":  "rar",
+	"application/zip":               "zip",
+	"application/ogg":               "ogg",
+	"application/vnd.ms-fontobject": "eot",
+	"audio/aiff":                    "aiff",
+	"audio/basic":                   "au",
+	"audio/midi":                    "mid",
+	"audio/mpeg":                    "mp3",
+	"audio/wave":                    "wav",
+	"font/otf":                      "otf",
+	"font/ttf":                      "ttf",
+	"font/woff":                     "woff",
+	"font/woff2":                    "woff2",
+	"image/bmp":                     "bmp",
+	"image/webp":                    "webp",
+	"image/x-icon":                  "ico",
+	"text/html":                     "html",
+	"text/plain":                    "txt",
+	"text/xml":                      "xml",
+	"video/avi":                     "avi",
+	"video/mp4":                     "mp4",
+	"video/webm":                    "webm",
+}
+
+// contentTypeAliases maps from MIME types reported by http.DetectContentType
+// to the other extensions commonly used by files of that type, beyond those
+// known to mime.ExtensionsByType. Many formats are containers (e.g. a DOCX
+// file is a ZIP archive) or plain text (e.g. CSV & JSON), which
+// DetectContentType cannot tell apart from the container.
+var contentTypeAliases = map[string][]string{
+	"application/ogg":        {"oga", "ogv", "opus", "spx"},
+	"application/postscript": {"eps", "ai"},
+	"application/x-gzip":     {"tgz", "svgz"},
+	"application/zip":        {"docx", "xlsx", "pptx", "odt", "ods", "odp", "odg", "epub", "jar", "war", "apk", "aab", "ipa", "xpi", "crx", "kmz", "cbz", "whl", "nupkg", "vsix", "3mf"},
+	"audio/aiff":             {"aif", "aifc"},
+	"audio/midi":             {"midi", "kar"},
+	"audio/wave":             {"wave"},
+	"font/ttf":               {"ttc"},
+	"image/x-icon":           {"cur"},
+	"text/html":              {"htm", "xhtml", "shtml"},
+	"text/plain":             {"csv", "tsv", "json", "ndjson", "jsonl", "geojson", "md", "markdown", "rst", "log", "ini", "cfg", "conf", "env", "properties", "yaml", "yml", "toml", "sh", "bash", "zsh", "bat", "ps1", "py", "rb", "pl", "go", "rs", "c", "h", "cc", "cpp", "hpp", "java", "js", "mjs", "ts", "css", "scss", "sql", "tex", "srt", "vtt", "diff", "patch", "svg"},
+	"text/xml":               {"svg", "rss", "atom", "xhtml", "plist", "xsd", "xslt", "kml", "gpx", "wsdl", "xliff", "opml"},
+	"video/mp4":              {"m4v", "m4a", "m4b", "mov", "3gp"},
+}
+
+// genericContentTypes are the MIME types which DetectContentType reports for
+// what may be any of many more specific formats. Files of these types keep any
+// recognized extension, even one not associated with the type; only those
+// with no extension, or an unrecognized one, are given the type's extension.
+var genericContentTypes = map[string]bool{
+	"application/zip": true,
+	"text/plain":      true,
+	"text/xml":        true,
+}
+
+// sniffContentType determines the type of a file with the given header from
+// its MIME type, as detected by http.DetectContentType. If the file's current
+// extension, curExt (without a leading dot; possibly empty), is one used for
+// that type, it is returned in preference to the type's usual extension. ok
+// is false if the type is not listed in contentTypeExts.
+func sniffContentType(header []byte, curExt string) (ext string, ok bool) {
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(header))
+	if err != nil {
+		return "", false
+	}
+	ext, ok = contentTypeExts[mt]
+	if !ok {
+		return "", false
+	}
+	if curExt = strings.ToLower(curExt); curExt != "" {
+		if isContentTypeExt(mt, curExt) || genericContentTypes[mt] && isKnownExt(curExt) {
+			return curExt, true
+		}
+	}
+	return ext, true
+}
+
+// isContentTypeExt determines whether the given (lower-cased, dotless)
+// extension is used by files of MIME type mt.
+func isContentTypeExt(mt, ext string) bool {
+	if contentTypeExts[mt] == ext {
+		return true
+	}
+	for _, e := range contentTypeAliases[mt] {
+		if e == ext {
+			return true
+		}
+	}
+	exts, _ := mime.ExtensionsByType(mt)
+	for _, e := range exts {
+		if e == "."+ext {
+			return true
+		}
+	}
+	return false
+}
+
+// isKnownExt determines whether the given (lower-cased, dotless) extension is
+// recognized as that of any specific type. Extensions registered only as
+// "application/octet-stream" (e.g. "bin") say nothing of a file's type, and
+// are not recognized.
+func isKnownExt(ext string) bool {
+	if mt, _, err := mime.ParseMediaType(mime.TypeByExtension("." + ext)); err == nil && mt != "application/octet-stream" {
+		return true
+	}
+	for mt := range contentTypeExts {
+		if isContentTypeExt(mt, ext) {
+			return true
+		}
+	}
+	return false
+}
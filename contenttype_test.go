@@ -0,0 +1,73 @@
+package imgext
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var pdfData = []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n%%EOF\n")
+
+func TestNonImages(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error // without NonImages
+	}{
+		{"pdf", pdfData, "pdf", ErrUnsupportedFormat},
+		{"text", textData, "txt", ErrUnsupportedFormat},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "html", ErrUnsupportedFormat},
+		// The image decoders are authoritative for images.
+		{"png", pngData, "png", nil},
+		{"jpeg", jpegData, "jpg", nil},
+	} {
+		if got, err := (Classifier{NonImages: true}).ClassifyBytes(test.data); got != test.want || err != nil {
+			t.Errorf("%s: ClassifyBytes with NonImages = %q, %v; want %q, nil", test.name, got, err, test.want)
+		}
+		want := test.want
+		if test.wantErr != nil {
+			want = ""
+		}
+		if got, err := ClassifyBytes(test.data); got != want || !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: ClassifyBytes = %q, %v; want %q, %v", test.name, got, err, want, test.wantErr)
+		}
+	}
+
+	// Content which is not recognized at all is still unsupported.
+	if got, err := (Classifier{NonImages: true}).ClassifyBytes([]byte{0, 1, 2, 3, 0xFE, 0xFF}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("ClassifyBytes(binary) with NonImages = %q, %v; want an error wrapping %v", got, err, ErrUnsupportedFormat)
+	}
+}
+
+func TestNonImagesKeepExt(t *testing.T) {
+	zipData := []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00")
+	xmlData := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`)
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		// Extensions used for the detected type are kept.
+		{"report.docx", zipData, "docx"},
+		{"REPORT.DOCX", zipData, "docx"},
+		{"icon.svg", xmlData, "svg"},
+		{"data.csv", textData, "csv"},
+		{"cfg.json", textData, "json"},
+		{"run.sh", textData, "sh"},
+		{"page.htm", []byte("<!DOCTYPE html><html></html>"), "htm"},
+		// Generic types are only given to files without a recognized extension.
+		{"notes", textData, "txt"},
+		{"notes.bin", textData, "txt"},
+		{"notes.zzq", textData, "txt"},
+		{"archive", zipData, "zip"},
+		{"doc.pdf", textData, "pdf"},
+		// Other types are given to files with any other extension.
+		{"doc.txt", pdfData, "pdf"},
+		{"doc.docx", pdfData, "pdf"},
+	} {
+		if got, err := (Classifier{NonImages: true}).ClassifyName(bytes.NewReader(test.data), test.name); got != test.want || err != nil {
+			t.Errorf("ClassifyName(%q) with NonImages = %q, %v; want %q, nil", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package imgext
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+)
+
+// Sentinel errors describing why a file could not be handled. Errors returned
+// while handling a file wrap the appropriate sentinel, if any, so that callers
+// may use errors.Is.
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format")                  // the file's content is not of a recognized type
+	ErrDestinationExists = errors.New("destination already exists")          // the file's destination is already taken
+	ErrVanished          = errors.New("file vanished")                       // the file no longer exists
+	ErrEmpty             = errors.New("file is empty")                       // the file has no content to classify
+	ErrReadOnlyFS        = errors.New("filesystem does not support renames") // an fs.FS does not implement RenameFS
+)
+
+// wrapKind wraps err with the sentinel error describing its kind, if any.
+func wrapKind(err error) error {
+	switch {
+	case errors.Is(err, image.ErrFormat) && !errors.Is(err, ErrUnsupportedFormat):
+		return fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	case errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrVanished):
+		return fmt.Errorf("%w: %w", ErrVanished, err)
+	default:
+		return err
+	}
+}
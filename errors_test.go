@@ -0,0 +1,48 @@
+package imgext
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestErrorKinds(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"pic.bin": pngData, "pic.png": gifData} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := fstest.MapFS{"empty.bin": {}, "pic.bin": {Data: pngData}}
+	apply := func(plan ...Rename) error {
+		res, err := Apply(plan, ExecuteOptions{})
+		if err != nil {
+			return err
+		}
+		return res.Outcomes[0].Err
+	}
+
+	for _, test := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"unsupported bytes", second(ClassifyBytes(textData)), ErrUnsupportedFormat},
+		{"empty bytes", second(ClassifyBytes(nil)), ErrEmpty},
+		{"empty file", second(ClassifyFS(fsys, "empty.bin")), ErrEmpty},
+		{"missing file", second(ClassifyFS(fsys, "missing.bin")), ErrVanished},
+		{"read-only filesystem", second(FixFS(fsys, "pic.bin")), ErrReadOnlyFS},
+		{"destination exists", apply(Rename{filepath.Join(dir, "pic.bin"), filepath.Join(dir, "pic.png")}), ErrDestinationExists},
+		{"source vanished", apply(Rename{filepath.Join(dir, "missing.bin"), filepath.Join(dir, "missing.png")}), ErrVanished},
+	} {
+		if !errors.Is(test.err, test.want) {
+			t.Errorf("%s: got error %v, want one wrapping %v", test.name, test.err, test.want)
+		}
+	}
+}
+
+// second returns its second argument, the error of a call returning a value &
+// an error.
+func second[T any](_ T, err error) error { return err }
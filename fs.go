@@ -0,0 +1,87 @@
+package imgext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// RenameFS is an fs.FS which additionally supports renaming files. It is
+// required by FixFS; read-only filesystems, such as embed.FS or those backed
+// by zip archives, may only be used with ClassifyFS.
+type RenameFS interface {
+	fs.FS
+	Rename(oldname, newname string) error
+}
+
+// ClassifyFS determines the type of the image in the named file of fsys,
+// returning the extension (without a leading dot) that it should have. It is
+// equivalent to the zero Classifier's ClassifyFS method.
+func ClassifyFS(fsys fs.FS, name string) (string, error) {
+	return Classifier{}.ClassifyFS(fsys, name)
+}
+
+// FixFS classifies the named file of fsys, renaming it to have the correct
+// extension if necessary. It is equivalent to the zero Classifier's FixFS
+// method.
+func FixFS(fsys fs.FS, name string) (string, error) {
+	return Classifier{}.FixFS(fsys, name)
+}
+
+// ClassifyFS determines the type of the image in the named file of fsys,
+// returning the extension (without a leading dot) that it should have.
+// Detection is the same as for files on disk.
+func (c Classifier) ClassifyFS(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't open: %w", wrapKind(err))
+	}
+	defer f.Close()
+	if r, ok := f.(io.ReaderAt); ok {
+		typ, err := c.ClassifyName(r, name)
+		if err != nil {
+			return "", fmt.Errorf("couldn't classify: %w", err)
+		}
+		return typ, nil
+	}
+
+	// The file does not support random access, so read it into memory.
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read: %w", err)
+	}
+	typ, err := c.ClassifyName(bytes.NewReader(data), name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't classify: %w", err)
+	}
+	return typ, nil
+}
+
+// FixFS classifies the named file of fsys, renaming it to have the correct
+// extension if necessary, and returns its (possibly new) name. fsys must
+// implement RenameFS; otherwise ErrReadOnlyFS is returned.
+func (c Classifier) FixFS(fsys fs.FS, name string) (string, error) {
+	rfs, ok := fsys.(RenameFS)
+	if !ok {
+		return "", ErrReadOnlyFS
+	}
+	typ, err := c.ClassifyFS(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	newFN := NewName(name, typ)
+	if newFN == name {
+		return name, nil
+	}
+	if _, err := fs.Stat(fsys, newFN); err == nil {
+		return "", fmt.Errorf("%w: %q", ErrDestinationExists, newFN)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("couldn't stat destination: %w", err)
+	}
+	if err := rfs.Rename(name, newFN); err != nil {
+		return "", fmt.Errorf("couldn't rename: %w", wrapKind(err))
+	}
+	return newFN, nil
+}
@@ -0,0 +1,102 @@
+package imgext
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// renameMapFS is a RenameFS backed by an fstest.MapFS.
+type renameMapFS struct{ fstest.MapFS }
+
+func (m renameMapFS) Rename(oldname, newname string) error {
+	f, ok := m.MapFS[oldname]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	delete(m.MapFS, oldname)
+	m.MapFS[newname] = f
+	return nil
+}
+
+// streamFS is an fs.FS whose files do not support random access.
+type streamFS struct{ fsys fs.FS }
+
+func (s streamFS) Open(name string) (fs.File, error) {
+	f, err := s.fsys.Open(name)
+	return struct{ fs.File }{f}, err
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"photo.jpeg":  {Data: jpegData},
+		"dir/pic.bin": {Data: pngData},
+		"dir/anim":    {Data: gifData},
+		"notes.txt":   {Data: textData},
+		"ok.png":      {Data: pngData},
+		"taken.bin":   {Data: pngData},
+		"taken.png":   {Data: gifData},
+		"empty.bin":   {},
+	}
+}
+
+func TestClassifyFS(t *testing.T) {
+	for _, fsys := range []fs.FS{testFS(), streamFS{testFS()}} {
+		for _, test := range []struct {
+			name, want string
+			wantErr    error
+		}{
+			{"photo.jpeg", "jpg", nil},
+			{"dir/pic.bin", "png", nil},
+			{"dir/anim", "gif", nil},
+			{"notes.txt", "", ErrUnsupportedFormat},
+			{"empty.bin", "", ErrEmpty},
+			{"missing", "", ErrVanished},
+		} {
+			got, err := ClassifyFS(fsys, test.name)
+			if got != test.want || !errors.Is(err, test.wantErr) {
+				t.Errorf("ClassifyFS(%T, %q) = %q, %v; want %q, %v", fsys, test.name, got, err, test.want, test.wantErr)
+			}
+		}
+	}
+
+	// Classifier options apply, too.
+	if got, err := (Classifier{NonImages: true}).ClassifyFS(testFS(), "notes.txt"); got != "txt" || err != nil {
+		t.Errorf("ClassifyFS(notes.txt) with NonImages = %q, %v; want %q, nil", got, err, "txt")
+	}
+}
+
+func TestFixFS(t *testing.T) {
+	fsys := renameMapFS{testFS()}
+	for _, test := range []struct {
+		name, want string
+		wantErr    error
+	}{
+		{"photo.jpeg", "photo.jpg", nil},
+		{"dir/pic.bin", "dir/pic.png", nil},
+		{"dir/anim", "dir/anim.gif", nil},
+		{"ok.png", "ok.png", nil},
+		{"taken.bin", "", ErrDestinationExists},
+		{"notes.txt", "", ErrUnsupportedFormat},
+	} {
+		got, err := FixFS(fsys, test.name)
+		if got != test.want || !errors.Is(err, test.wantErr) {
+			t.Errorf("FixFS(%q) = %q, %v; want %q, %v", test.name, got, err, test.want, test.wantErr)
+		}
+	}
+	for _, name := range []string{"photo.jpg", "dir/pic.png", "dir/anim.gif", "ok.png", "taken.bin", "taken.png", "notes.txt"} {
+		if _, ok := fsys.MapFS[name]; !ok {
+			t.Errorf("%q does not exist afterward", name)
+		}
+	}
+	for _, name := range []string{"photo.jpeg", "dir/pic.bin", "dir/anim"} {
+		if _, ok := fsys.MapFS[name]; ok {
+			t.Errorf("%q still exists afterward", name)
+		}
+	}
+
+	if _, err := FixFS(testFS(), "photo.jpeg"); !errors.Is(err, ErrReadOnlyFS) {
+		t.Errorf("FixFS on a read-only filesystem: got error %v, want %v", err, ErrReadOnlyFS)
+	}
+}
@@ -0,0 +1,34 @@
+package imgext
+
+import "bytes"
+
+// Signatures of JPEG XL files (ISO/IEC 18181-2): either a bare codestream, or
+// an ISOBMFF container whose first box is the 12-byte JPEG XL signature box.
+var (
+	jxlCodestreamSig = []byte{0xFF, 0x0A}
+	jxlContainerSig  = []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A}
+)
+
+// jxlMinCodestreamSize is the size of the smallest bare codestream which is
+// recognized. The signature is followed by (at least) the image's size header
+// & metadata, a frame header and the frame's data, so real images are larger
+// than this.
+const jxlMinCodestreamSize = 12
+
+func init() { RegisterSniffer("jxl", sniffJXL) }
+
+// sniffJXL recognizes JPEG XL files, which the standard library cannot decode.
+// The container signature is long enough to be unambiguous. The codestream
+// signature is only two bytes, so a bare codestream is only recognized if it is
+// at least jxlMinCodestreamSize bytes long; no other supported format begins
+// with these bytes.
+func sniffJXL(header []byte) (ext string, ok bool) {
+	switch {
+	case bytes.HasPrefix(header, jxlContainerSig):
+		return "jxl", true
+	case bytes.HasPrefix(header, jxlCodestreamSig) && len(header) >= jxlMinCodestreamSize:
+		return "jxl", true
+	default:
+		return "", false
+	}
+}
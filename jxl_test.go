@@ -0,0 +1,47 @@
+package imgext
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSniffJXL(t *testing.T) {
+	pad := func(b []byte, n int) []byte { return append(append([]byte(nil), b...), make([]byte, n)...) }
+	for _, test := range []struct {
+		name   string
+		header []byte
+		want   bool
+	}{
+		{"container", pad(jxlContainerSig, 32), true},
+		{"container alone", jxlContainerSig, true},
+		{"codestream", pad(jxlCodestreamSig, 32), true},
+		{"shortest codestream", pad(jxlCodestreamSig, jxlMinCodestreamSize-len(jxlCodestreamSig)), true},
+		{"too-short codestream", pad(jxlCodestreamSig, jxlMinCodestreamSize-len(jxlCodestreamSig)-1), false},
+		{"codestream signature alone", jxlCodestreamSig, false},
+		{"partial container signature", pad(jxlContainerSig[:8], 32), false},
+		{"other box", pad([]byte("\x00\x00\x00\x0cJXL!\r\n\x87\n"), 32), false},
+		{"jpeg", jpegData, false},
+		{"png", pngData, false},
+		{"text", textData, false},
+	} {
+		if ext, ok := sniffJXL(test.header); ok != test.want || ok && ext != "jxl" {
+			t.Errorf("%s: sniffJXL = %q, %t; want ok = %t", test.name, ext, ok, test.want)
+		}
+	}
+}
+
+func TestClassifyJXL(t *testing.T) {
+	for _, data := range [][]byte{
+		append(append([]byte(nil), jxlContainerSig...), make([]byte, 32)...),
+		append([]byte{0xFF, 0x0A}, make([]byte, 32)...),
+	} {
+		if ext, err := ClassifyBytes(data); ext != "jxl" || err != nil {
+			t.Errorf("ClassifyBytes(% x...) = %q, %v; want %q, nil", data[:4], ext, err, "jxl")
+		}
+	}
+	// A file which merely begins with the codestream signature is not taken
+	// for JPEG XL.
+	if ext, err := ClassifyBytes([]byte{0xFF, 0x0A, 'h', 'i'}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("ClassifyBytes(short) = %q, %v; want an error wrapping %v", ext, err, ErrUnsupportedFormat)
+	}
+}
@@ -0,0 +1,94 @@
+package imgext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// rawTypeMap maps from the (upper-cased, first word of the) Make tag of a
+// TIFF-based RAW file to the canonical extension of that manufacturer's RAW
+// format. Canon's CR2 files are recognized by their magic instead.
+var rawTypeMap = map[string]string{
+	"NIKON":   "nef",
+	"SONY":    "arw",
+	"PENTAX":  "pef",
+	"SAMSUNG": "srw",
+}
+
+// TIFF tags consulted while sniffing RAW files.
+const (
+	tiffTagMake       = 0x010F
+	tiffTagDNGVersion = 0xC612
+	tiffTypeASCII     = 2
+)
+
+// sniffRAWHeader determines the RAW camera format of a file with the given
+// header. ok is false if the header is not recognized.
+func sniffRAWHeader(hdr []byte) (ext string, ok bool) {
+	// Formats with their own magic.
+	switch {
+	case bytes.HasPrefix(hdr, []byte("FUJIFILMCCD-RAW")):
+		return "raf", true
+	case len(hdr) >= 12 && string(hdr[4:12]) == "ftypcrx ":
+		return "cr3", true
+	case bytes.HasPrefix(hdr, []byte("IIRO")), bytes.HasPrefix(hdr, []byte("IIRS")), bytes.HasPrefix(hdr, []byte("MMOR")):
+		return "orf", true
+	case bytes.HasPrefix(hdr, []byte("IIU\x00")):
+		return "rw2", true
+	}
+
+	// TIFF-based formats.
+	var bo binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(hdr, []byte("II*\x00")):
+		bo = binary.LittleEndian
+	case bytes.HasPrefix(hdr, []byte("MM\x00*")):
+		bo = binary.BigEndian
+	default:
+		return "", false
+	}
+	if len(hdr) >= 10 && string(hdr[8:10]) == "CR" {
+		return "cr2", true
+	}
+
+	// Walk IFD0 looking for the DNGVersion & Make tags.
+	if len(hdr) < 8 {
+		return "", false
+	}
+	off := int64(bo.Uint32(hdr[4:8]))
+	if off+2 > int64(len(hdr)) {
+		return "", false
+	}
+	entryCount := int64(bo.Uint16(hdr[off:]))
+	var mk string
+	for i := int64(0); i < entryCount; i++ {
+		e := off + 2 + 12*i
+		if e+12 > int64(len(hdr)) {
+			break
+		}
+		switch bo.Uint16(hdr[e:]) {
+		case tiffTagDNGVersion:
+			return "dng", true
+		case tiffTagMake:
+			if bo.Uint16(hdr[e+2:]) != tiffTypeASCII {
+				continue
+			}
+			cnt := int64(bo.Uint32(hdr[e+4:]))
+			valOff := e + 8
+			if cnt > 4 {
+				valOff = int64(bo.Uint32(hdr[e+8:]))
+			}
+			if valOff+cnt > int64(len(hdr)) {
+				continue
+			}
+			mk = strings.TrimRight(string(hdr[valOff:valOff+cnt]), "\x00 ")
+		}
+	}
+	if fields := strings.Fields(strings.ToUpper(mk)); len(fields) > 0 {
+		if ext, ok := rawTypeMap[fields[0]]; ok {
+			return ext, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,116 @@
+package imgext
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// byteOrder is a byte order in which TIFF files may be built.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// tiffEntry is an entry of an IFD built by tiffFile.
+type tiffEntry struct {
+	tag, typ uint16
+	value    []byte // for ASCII entries, including any NUL terminator
+}
+
+// tiffFile returns a TIFF file in byte order bo, holding an IFD0 with the given
+// entries. Values longer than 4 bytes are stored after the IFD.
+func tiffFile(bo byteOrder, entries ...tiffEntry) []byte {
+	b := []byte("II*\x00")
+	if bo == binary.BigEndian {
+		b = []byte("MM\x00*")
+	}
+	b = bo.AppendUint32(b, 8)
+	b = bo.AppendUint16(b, uint16(len(entries)))
+	dataOff := 8 + 2 + 12*len(entries) + 4
+	var data []byte
+	for _, e := range entries {
+		b = bo.AppendUint16(b, e.tag)
+		b = bo.AppendUint16(b, e.typ)
+		b = bo.AppendUint32(b, uint32(len(e.value)))
+		if len(e.value) <= 4 {
+			b = append(b, e.value...)
+			b = append(b, make([]byte, 4-len(e.value))...)
+			continue
+		}
+		b = bo.AppendUint32(b, uint32(dataOff+len(data)))
+		data = append(data, e.value...)
+	}
+	b = bo.AppendUint32(b, 0) // no next IFD
+	return append(b, data...)
+}
+
+// makeEntry returns an IFD entry holding the given Make.
+func makeEntry(mk string) tiffEntry {
+	return tiffEntry{tiffTagMake, tiffTypeASCII, []byte(mk + "\x00")}
+}
+
+func TestSniffRAWHeader(t *testing.T) {
+	dngVersion := tiffEntry{tiffTagDNGVersion, 1, []byte{1, 4, 0, 0}}
+	for _, bo := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		cr2 := tiffFile(bo, makeEntry("Canon"))
+		copy(cr2[4:], bo.AppendUint32(nil, 16))
+		cr2 = append(cr2[:8], append([]byte("CR\x02\x00\x00\x00\x00\x00"), cr2[8:]...)...)
+
+		for _, test := range []struct {
+			name string
+			hdr  []byte
+			want string // or "" if not recognized
+		}{
+			{"cr2", cr2, "cr2"},
+			{"dng", tiffFile(bo, makeEntry("Canon"), dngVersion), "dng"},
+			{"dng from a recognized make", tiffFile(bo, makeEntry("NIKON CORPORATION"), dngVersion), "dng"},
+			{"nef", tiffFile(bo, makeEntry("NIKON CORPORATION")), "nef"},
+			{"arw", tiffFile(bo, makeEntry("SONY")), "arw"},
+			{"arw, inline make", tiffFile(bo, tiffEntry{tiffTagMake, tiffTypeASCII, []byte("SONY")}), "arw"},
+			{"pef", tiffFile(bo, makeEntry("Pentax Corporation")), "pef"},
+			{"srw", tiffFile(bo, makeEntry("SAMSUNG")), "srw"},
+
+			// A plain TIFF, or one from another manufacturer, is not RAW.
+			{"plain tiff", tiffFile(bo, tiffEntry{0x0100, 3, []byte{0, 4}}), ""},
+			{"other make", tiffFile(bo, makeEntry("Canon")), ""},
+			{"make padded", tiffFile(bo, makeEntry("   ")), ""},
+			{"make of wrong type", tiffFile(bo, tiffEntry{tiffTagMake, 7, []byte("NIKON\x00")}), ""},
+
+			// Truncated or malformed IFDs are not recognized, and do not panic.
+			{"header only", tiffFile(bo)[:4], ""},
+			{"ifd offset past end", tiffFile(bo, makeEntry("NIKON CORPORATION"))[:9], ""},
+			{"entries past end", tiffFile(bo, makeEntry("NIKON CORPORATION"))[:16], ""},
+			{"make value past end", tiffFile(bo, makeEntry("NIKON CORPORATION"))[:30], ""},
+			{"make offset huge", hugeMakeOffset(bo), ""},
+		} {
+			got, ok := sniffRAWHeader(test.hdr)
+			if got != test.want || ok != (test.want != "") {
+				t.Errorf("%s (%v): sniffRAWHeader = %q, %t; want %q, %t", test.name, bo, got, ok, test.want, test.want != "")
+			}
+		}
+	}
+}
+
+// hugeMakeOffset returns a TIFF file whose Make value is at an offset far past
+// its end.
+func hugeMakeOffset(bo byteOrder) []byte {
+	b := tiffFile(bo, makeEntry("NIKON CORPORATION"))
+	copy(b[8+2+8:], bo.AppendUint32(nil, 0xFFFFFFFF))
+	return b
+}
+
+func TestClassifyRAW(t *testing.T) {
+	nef := tiffFile(binary.LittleEndian, makeEntry("NIKON CORPORATION"))
+	if got, err := (Classifier{RAW: true}).ClassifyBytes(nef); got != "nef" || err != nil {
+		t.Errorf("ClassifyBytes(nef) with RAW = %q, %v; want %q, nil", got, err, "nef")
+	}
+	// RAW formats are only recognized if enabled; TIFF is not otherwise supported.
+	if got, err := ClassifyBytes(nef); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("ClassifyBytes(nef) = %q, %v; want an error wrapping %v", got, err, ErrUnsupportedFormat)
+	}
+	plain := tiffFile(binary.BigEndian, tiffEntry{0x0100, 3, []byte{0, 4}})
+	if got, err := (Classifier{RAW: true}).ClassifyBytes(plain); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("ClassifyBytes(plain tiff) with RAW = %q, %v; want an error wrapping %v", got, err, ErrUnsupportedFormat)
+	}
+}
@@ -0,0 +1,93 @@
+package imgext
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Windows error codes indicating that a file is held open by another process.
+const (
+	errorSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+	errorLockViolation    syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// Parameters for retrying renames of files which are in use.
+const (
+	inUseAttempts     = 5
+	inUseInitialDelay = 100 * time.Millisecond
+)
+
+// renameFile renames from to to. Case-only renames on case-insensitive
+// filesystems are performed in two steps, via a temporary name. On Windows,
+// renames which fail because the file is in use by another process are retried
+// with backoff.
+func renameFile(from, to string) error {
+	if from != to && strings.EqualFold(from, to) {
+		if fromFI, err := os.Lstat(from); err == nil {
+			if toFI, err := os.Lstat(to); err == nil && os.SameFile(fromFI, toFI) && !hasEntry(to) {
+				tmp := fmt.Sprintf("%s.imgext-%d.tmp", from, time.Now().UnixNano())
+				if err := renameRetry(from, tmp); err != nil {
+					return err
+				}
+				if err := renameRetry(tmp, to); err != nil {
+					return fmt.Errorf("%w (file left at %q)", err, tmp)
+				}
+				return nil
+			}
+		}
+	}
+	return renameRetry(from, to)
+}
+
+// hasEntry determines whether the directory containing fn has an entry named
+// exactly like fn's final element, as opposed to one which merely matches it
+// case-insensitively.
+func hasEntry(fn string) bool {
+	names, err := os.ReadDir(filepath.Dir(fn))
+	if err != nil {
+		return false
+	}
+	base := filepath.Base(fn)
+	for _, n := range names {
+		if n.Name() == base {
+			return true
+		}
+	}
+	return false
+}
+
+// renameRetry renames from to to. On Windows, renames which fail because the
+// file is in use by another process are retried with backoff.
+func renameRetry(from, to string) error {
+	delay := inUseInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := os.Rename(from, to)
+		if err == nil || !isInUse(runtime.GOOS, err) {
+			return err
+		}
+		if attempt == inUseAttempts {
+			return fmt.Errorf("file is in use by another process (gave up after %d attempts): %w", attempt, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isInUse determines whether err, returned by a filesystem operation on the
+// given GOOS, indicates that the file is in use by another process.
+func isInUse(goos string, err error) bool {
+	if goos != "windows" {
+		return false
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == errorSharingViolation || errno == errorLockViolation
+}
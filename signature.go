@@ -0,0 +1,29 @@
+package imgext
+
+import "strings"
+
+// signatures maps from the leading bytes of files of each format supported by
+// the registered image decoders to the name of that format, as reported by
+// image.DecodeConfig.
+var signatures = []struct {
+	magic string
+	typ   string
+}{
+	{"\x89PNG\r\n\x1a\n", "png"},
+	{"GIF87a", "gif"},
+	{"GIF89a", "gif"},
+	{"\xff\xd8", "jpeg"},
+}
+
+// sniffSignature determines the format of the image with the given header
+// using only its leading bytes. Unlike image.DecodeConfig, it never reads
+// further into the file, at the cost of not noticing files which are corrupt
+// past their signature. ok is false if no signature matches.
+func sniffSignature(header []byte) (typ string, ok bool) {
+	for _, sig := range signatures {
+		if strings.HasPrefix(string(header), sig.magic) {
+			return sig.typ, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,90 @@
+package imgext
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// bigJPEG is a JPEG image whose frame header is preceded by 4 MiB of
+// application segments, as in files with large embedded metadata or
+// thumbnails, so that decoding its configuration reads the whole 4 MiB.
+var bigJPEG = func() []byte {
+	var b bytes.Buffer
+	b.Write(jpegData[:2]) // SOI
+	seg := make([]byte, 0xFFFF-2)
+	for b.Len() < 4<<20 {
+		b.Write([]byte{0xFF, 0xE1, 0xFF, 0xFF}) // APP1, of maximal length
+		b.Write(seg)
+	}
+	b.Write(jpegData[2:])
+	return b.Bytes()
+}()
+
+// countingReaderAt is an io.ReaderAt which counts the bytes read from it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestSignatureOnly(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"png", pngData},
+		{"jpeg", jpegData},
+		{"gif", gifData},
+		{"big jpeg", bigJPEG},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			full := &countingReaderAt{r: bytes.NewReader(test.data)}
+			wantExt, err := Classifier{}.Classify(full)
+			if err != nil {
+				t.Fatalf("Classify: %v", err)
+			}
+			sig := &countingReaderAt{r: bytes.NewReader(test.data)}
+			ext, err := Classifier{SignatureOnly: true}.Classify(sig)
+			if err != nil || ext != wantExt {
+				t.Errorf("Classify with SignatureOnly = %q, %v; want %q (as with a full decode)", ext, err, wantExt)
+			}
+			if sig.n > snifferHeaderSize {
+				t.Errorf("Classify with SignatureOnly read %d bytes, want at most %d", sig.n, snifferHeaderSize)
+			}
+			t.Logf("Read %d bytes with SignatureOnly, %d without", sig.n, full.n)
+		})
+	}
+
+	// The large file must in fact be read in full without SignatureOnly, or
+	// the above does not measure anything.
+	full := &countingReaderAt{r: bytes.NewReader(bigJPEG)}
+	if _, err := (Classifier{}).Classify(full); err != nil || full.n < 4<<20 {
+		t.Errorf("Classify without SignatureOnly read %d bytes (err = %v), want at least %d", full.n, err, 4<<20)
+	}
+}
+
+// BenchmarkClassify measures the time taken, and bytes read, to classify a
+// large JPEG with & without SignatureOnly.
+func BenchmarkClassify(b *testing.B) {
+	for _, sigOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("SignatureOnly=%t", sigOnly), func(b *testing.B) {
+			c := Classifier{SignatureOnly: sigOnly}
+			var read int64
+			for i := 0; i < b.N; i++ {
+				r := &countingReaderAt{r: bytes.NewReader(bigJPEG)}
+				if _, err := c.Classify(r); err != nil {
+					b.Fatal(err)
+				}
+				read += r.n
+			}
+			b.ReportMetric(float64(read)/float64(b.N), "bytes-read/op")
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package imgext
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// snifferHeaderSize is the maximum number of bytes read from the start of a
+// file and passed to the registered sniffers. It is enough to hold the first
+// IFD of TIFF-based RAW files.
+const snifferHeaderSize = 4096
+
+// sniffer is a function registered via RegisterSniffer.
+type sniffer struct {
+	name string
+	fn   func(header []byte) (ext string, ok bool)
+}
+
+var (
+	sniffersMu sync.RWMutex
+	sniffers   []sniffer // in priority order
+)
+
+// RegisterSniffer registers a function which recognizes a file format from the
+// leading bytes of a file, returning the extension (without a leading dot)
+// that files of that format should have. Sniffers are consulted in the order
+// they were registered, before the registered image decoders; the first to
+// return ok determines the file's type. The extension must be non-empty and
+// must not contain a path separator; files for which fn returns any other
+// extension fail to be classified.
+//
+// The header passed to fn holds the first 4096 bytes of the file, or the whole
+// file if it is shorter; it is never empty. fn must not modify or retain it.
+// RegisterSniffer panics if a sniffer with the same name is already
+// registered. It is typically called from an init function.
+func RegisterSniffer(name string, fn func(header []byte) (ext string, ok bool)) {
+	sniffersMu.Lock()
+	defer sniffersMu.Unlock()
+	for _, s := range sniffers {
+		if s.name == name {
+			panic(fmt.Sprintf("imgext: RegisterSniffer called twice for sniffer %q", name))
+		}
+	}
+	sniffers = append(sniffers, sniffer{name, fn})
+}
+
+// sniff determines the type of a file with the given header by consulting
+// each registered sniffer in turn, followed by those built-in sniffers enabled
+// by c (which, being configured per Classifier, are not registered). ok is
+// false if none recognize it. An error is returned if a registered sniffer
+// gives an extension which is not a valid one.
+func (c Classifier) sniff(hdr []byte) (ext string, ok bool, err error) {
+	sniffersMu.RLock()
+	defer sniffersMu.RUnlock()
+	for _, s := range sniffers {
+		if ext, ok := s.fn(hdr); ok {
+			if !validExt(ext) {
+				return "", false, fmt.Errorf("sniffer %q gave invalid extension %q", s.name, ext)
+			}
+			return ext, true, nil
+		}
+	}
+	if c.RAW {
+		if ext, ok := sniffRAWHeader(hdr); ok {
+			return ext, true, nil
+		}
+	}
+	if c.SignatureOnly {
+		if ext, ok := sniffSignature(hdr); ok {
+			return ext, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// validExt determines whether ext may be given to a file as its extension
+// (without a leading dot): it must be non-empty, and must not contain a path
+// separator or otherwise name anything other than the file itself.
+func validExt(ext string) bool {
+	return ext != "" && !strings.ContainsAny(ext, "/\\\x00") && strings.Trim(ext, ".") != ""
+}
@@ -0,0 +1,59 @@
+package imgext
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Test sniffers, recognizing content beginning with their magic.
+func init() {
+	for _, s := range []struct{ magic, ext string }{
+		{"IMGEXT-TEST-FOO", "foo"},
+		{"IMGEXT-TEST-TRAVERSE", "../x"},
+		{"IMGEXT-TEST-SEPARATOR", `x\y`},
+		{"IMGEXT-TEST-EMPTY", ""},
+		{"IMGEXT-TEST-DOTS", ".."},
+	} {
+		RegisterSniffer("test-"+s.ext, func(hdr []byte) (string, bool) {
+			return s.ext, bytes.HasPrefix(hdr, []byte(s.magic))
+		})
+	}
+	// Registered sniffers are consulted before the image decoders.
+	RegisterSniffer("test-png", func(hdr []byte) (string, bool) {
+		return "testpng", bytes.HasPrefix(hdr, pngData[:8]) && bytes.Contains(hdr, []byte("IMGEXT-TEST-PNG"))
+	})
+}
+
+func TestRegisterSniffer(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string // or "" for an error
+	}{
+		{"recognized", []byte("IMGEXT-TEST-FOO and more"), "foo"},
+		{"before decoders", append(append([]byte{}, pngData...), "IMGEXT-TEST-PNG"...), "testpng"},
+		{"unrecognized falls through", pngData, "png"},
+		{"traversing extension", []byte("IMGEXT-TEST-TRAVERSE"), ""},
+		{"separator in extension", []byte("IMGEXT-TEST-SEPARATOR"), ""},
+		{"empty extension", []byte("IMGEXT-TEST-EMPTY"), ""},
+		{"dots-only extension", []byte("IMGEXT-TEST-DOTS"), ""},
+	} {
+		got, err := ClassifyBytes(test.data)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s: ClassifyBytes = %q, want error", test.name, got)
+		case test.want != "" && (got != test.want || err != nil):
+			t.Errorf("%s: ClassifyBytes = %q, %v; want %q, nil", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestRegisterSnifferTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "test-foo") {
+			t.Errorf("RegisterSniffer of an existing name panicked with %v, want a panic naming it", r)
+		}
+	}()
+	RegisterSniffer("test-foo", func([]byte) (string, bool) { return "", false })
+}